@@ -24,7 +24,7 @@ resource "kubernetes_cluster_role" "container_image_exporter" {
 
   rule {
     api_groups = [""]
-    resources  = ["pods"]
+    resources  = ["pods", "nodes", "replicationcontrollers"]
     verbs      = ["get", "list", "watch"]
   }
 
@@ -36,7 +36,7 @@ resource "kubernetes_cluster_role" "container_image_exporter" {
 
   rule {
     api_groups = ["apps"]
-    resources  = ["deployments", "statefulsets", "daemonsets"]
+    resources  = ["deployments", "statefulsets", "daemonsets", "replicasets"]
     verbs      = ["get", "list", "watch"]
   }
 
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+
+	"github.com/ribbybibby/container-image-exporter/internal/controller"
+)
+
+// Config is the configuration file for the exporter
+type Config struct {
+	// Resources are the kinds of objects that the exporter will look for
+	// containers in. If this is empty, the default resources are used.
+	Resources []controller.Resource `json:"resources,omitempty"`
+
+	// Registries are limits for requests to specific registries, which
+	// override the default limits
+	Registries []controller.RegistryLimit `json:"registries,omitempty"`
+
+	// TagCacheDurations override how long the digest that a tag resolves to
+	// is cached for. The first one that matches a tag is used.
+	TagCacheDurations []controller.TagCacheDuration `json:"tagCacheDurations,omitempty"`
+}
+
+// Load reads and validates the configuration file at path
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+
+	// Controllers are named after the kind and group, so only one version
+	// of each kind can be watched
+	seen := map[schema.GroupKind]struct{}{}
+	for i, resource := range cfg.Resources {
+		if err := resource.Validate(); err != nil {
+			return nil, fmt.Errorf("validating resources[%d]: %w", i, err)
+		}
+		gk := resource.GroupVersionKind().GroupKind()
+		if _, ok := seen[gk]; ok {
+			return nil, fmt.Errorf("validating resources[%d]: %s is defined more than once, only one version of each kind can be exported", i, gk)
+		}
+		seen[gk] = struct{}{}
+	}
+
+	hosts := map[string]struct{}{}
+	for i, registry := range cfg.Registries {
+		if err := registry.Validate(); err != nil {
+			return nil, fmt.Errorf("validating registries[%d]: %w", i, err)
+		}
+		if _, ok := hosts[registry.Host]; ok {
+			return nil, fmt.Errorf("validating registries[%d]: %s is defined more than once", i, registry.Host)
+		}
+		hosts[registry.Host] = struct{}{}
+	}
+
+	for i, duration := range cfg.TagCacheDurations {
+		if err := duration.Validate(); err != nil {
+			return nil, fmt.Errorf("validating tagCacheDurations[%d]: %w", i, err)
+		}
+	}
+
+	return cfg, nil
+}
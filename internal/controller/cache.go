@@ -1,46 +1,92 @@
 package controller
 
 import (
+	"container/list"
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 // ErrContainerImageNotFound is returned when an item isn't in the cache
 var ErrContainerImageNotFound = fmt.Errorf("not found")
 
-// CachedContainerImage is a container image that we've cached
+// CachedContainerImage is a container image that we've cached. The time is
+// when the reference was last resolved to the image.
 type CachedContainerImage struct {
 	*ContainerImage
 	Time time.Time
 }
 
-// ContainerImageCache caches details about container images
+// ContainerImageCache caches details about container images. The platform is
+// the platform that a multi-architecture image was resolved to.
 type ContainerImageCache interface {
-	Get(ctx context.Context, ref name.Reference) (*CachedContainerImage, error)
-	Put(ctx context.Context, ref name.Reference, img *ContainerImage) error
+	Get(ctx context.Context, ref name.Reference, platform *v1.Platform) (*CachedContainerImage, error)
+	Put(ctx context.Context, ref name.Reference, platform *v1.Platform, img *ContainerImage) error
+
+	// Prune removes the references that haven't been in use for longer
+	// than the grace period, and the images that they refer to
+	Prune(ctx context.Context, inUse []name.Reference, grace time.Duration) error
+}
+
+// CacheOption is a functional option that configures a cache
+type CacheOption func(*cacheImpl)
+
+// WithMaxEntries is a functional option that limits the number of images in
+// the cache. When the limit is reached, the least recently used image is
+// evicted.
+func WithMaxEntries(n int) CacheOption {
+	return func(c *cacheImpl) {
+		c.maxEntries = n
+	}
 }
 
 type cacheImpl struct {
+	// digestMap maps references to digests
 	digestMap map[string]string
-	imageMap  map[string]*CachedContainerImage
-	lock      sync.Mutex
+
+	// imageMap maps digests and platforms to images
+	imageMap map[string]*CachedContainerImage
+
+	// resolved is the last time each reference was resolved to its digest
+	resolved map[string]time.Time
+
+	// referenced is the last time each reference was in use
+	referenced map[string]time.Time
+
+	// lru orders the keys in imageMap from the most to the least recently
+	// used
+	lru        *list.List
+	elements   map[string]*list.Element
+	maxEntries int
+
+	lock sync.Mutex
 }
 
 // NewContainerImageCache returns a new cache
-func NewContainerImageCache() ContainerImageCache {
-	return &cacheImpl{
-		digestMap: map[string]string{},
-		imageMap:  map[string]*CachedContainerImage{},
-		lock:      sync.Mutex{},
+func NewContainerImageCache(opts ...CacheOption) ContainerImageCache {
+	c := &cacheImpl{
+		digestMap:  map[string]string{},
+		imageMap:   map[string]*CachedContainerImage{},
+		resolved:   map[string]time.Time{},
+		referenced: map[string]time.Time{},
+		lru:        list.New(),
+		elements:   map[string]*list.Element{},
+		lock:       sync.Mutex{},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 // Get an image from the cache
-func (c *cacheImpl) Get(ctx context.Context, ref name.Reference) (*CachedContainerImage, error) {
+func (c *cacheImpl) Get(ctx context.Context, ref name.Reference, platform *v1.Platform) (*CachedContainerImage, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -57,16 +103,18 @@ func (c *cacheImpl) Get(ctx context.Context, ref name.Reference) (*CachedContain
 		return nil, ErrContainerImageNotFound
 	}
 
-	img, ok := c.imageMap[digestStr]
+	key := imageKey(digestStr, platform)
+	img, ok := c.imageMap[key]
 	if !ok {
 		return nil, ErrContainerImageNotFound
 	}
+	c.touch(key)
 
-	return img, nil
+	return c.withResolved(ref.String(), img), nil
 }
 
 // Put an image into the cache
-func (c *cacheImpl) Put(ctx context.Context, ref name.Reference, img *ContainerImage) error {
+func (c *cacheImpl) Put(ctx context.Context, ref name.Reference, platform *v1.Platform, img *ContainerImage) error {
 	if img == nil {
 		return nil
 	}
@@ -74,11 +122,245 @@ func (c *cacheImpl) Put(ctx context.Context, ref name.Reference, img *ContainerI
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	c.digestMap[ref.String()] = img.Digest
-	c.imageMap[img.Digest] = &CachedContainerImage{
-		ContainerImage: img,
-		Time:           time.Now(),
-	}
+	c.put(newCacheRecord(ref, platform, img, time.Now()))
 
 	return nil
 }
+
+// Prune removes the references that haven't been in use for longer than the
+// grace period, along with any images that are no longer referenced
+func (c *cacheImpl) Prune(ctx context.Context, inUse []name.Reference, grace time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.prune(inUse, grace)
+
+	return nil
+}
+
+// prune removes unused references and images and returns the number of
+// images that were evicted. The lock must be held by the caller.
+func (c *cacheImpl) prune(inUse []name.Reference, grace time.Duration) int {
+	// The platform images in an index are cached under their own digest in
+	// the same repository, so they're in use for as long as the index is
+	manifests := map[string][]PlatformManifest{}
+	for key, img := range c.imageMap {
+		digest, _, _ := strings.Cut(key, "|")
+		manifests[digest] = append(manifests[digest], img.Manifests...)
+	}
+
+	now := time.Now()
+	for _, ref := range inUse {
+		digest, ok := c.digestMap[ref.String()]
+		if !ok {
+			continue
+		}
+		c.referenced[ref.String()] = now
+		for _, manifest := range manifests[digest] {
+			child := ref.Context().Digest(manifest.Digest).String()
+			if _, ok := c.digestMap[child]; ok {
+				c.referenced[child] = now
+			}
+		}
+	}
+	for ref := range c.digestMap {
+		if now.Sub(c.referenced[ref]) > grace {
+			delete(c.digestMap, ref)
+			delete(c.resolved, ref)
+			delete(c.referenced, ref)
+		}
+	}
+
+	// Keep the images that are still referenced, and the platform images
+	// in any index that is still referenced
+	keep := map[string]struct{}{}
+	for _, digest := range c.digestMap {
+		keep[digest] = struct{}{}
+	}
+	for key, img := range c.imageMap {
+		digest, _, _ := strings.Cut(key, "|")
+		if _, ok := keep[digest]; !ok {
+			continue
+		}
+		for _, manifest := range img.Manifests {
+			keep[manifest.Digest] = struct{}{}
+		}
+	}
+
+	var evicted int
+	for key := range c.imageMap {
+		digest, _, _ := strings.Cut(key, "|")
+		if _, ok := keep[digest]; ok {
+			continue
+		}
+		c.evict(key, "unreferenced")
+		evicted++
+	}
+
+	return evicted
+}
+
+// touch marks the image as the most recently used. The lock must be held by
+// the caller.
+func (c *cacheImpl) touch(key string) {
+	if e, ok := c.elements[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.elements[key] = c.lru.PushFront(key)
+}
+
+// evict removes an image from the cache. The lock must be held by the caller.
+func (c *cacheImpl) evict(key, reason string) {
+	delete(c.imageMap, key)
+	if e, ok := c.elements[key]; ok {
+		c.lru.Remove(e)
+		delete(c.elements, key)
+	}
+
+	cacheEvictions.WithLabelValues(reason).Inc()
+	cacheEntries.Set(float64(len(c.imageMap)))
+}
+
+// get returns the entry for a reference and platform, or nil if there isn't
+// one. The lock must be held by the caller.
+func (c *cacheImpl) get(ref, platform string) *CachedContainerImage {
+	digest, ok := c.digestMap[ref]
+	if !ok {
+		return nil
+	}
+
+	img, ok := c.imageMap[digest+platformSuffix(platform)]
+	if !ok {
+		return nil
+	}
+
+	return c.withResolved(ref, img)
+}
+
+// withResolved returns the image with the time that the reference was
+// resolved to it. The lock must be held by the caller.
+func (c *cacheImpl) withResolved(ref string, img *CachedContainerImage) *CachedContainerImage {
+	t, ok := c.resolved[ref]
+	if !ok {
+		return img
+	}
+
+	return &CachedContainerImage{
+		ContainerImage: img.ContainerImage,
+		Time:           t,
+	}
+}
+
+// put adds a record to the cache. The lock must be held by the caller.
+func (c *cacheImpl) put(record cacheRecord) {
+	key := record.Image.Digest + platformSuffix(record.Platform)
+
+	c.digestMap[record.Ref] = record.Image.Digest
+	c.resolved[record.Ref] = record.Time
+	c.referenced[record.Ref] = time.Now()
+	c.imageMap[key] = &CachedContainerImage{
+		ContainerImage: record.Image,
+		Time:           record.Time,
+	}
+	c.touch(key)
+
+	// Evict the least recently used images if there are too many
+	for c.maxEntries > 0 && len(c.imageMap) > c.maxEntries {
+		c.evict(c.lru.Back().Value.(string), "lru")
+	}
+
+	cacheEntries.Set(float64(len(c.imageMap)))
+}
+
+// putLeastRecent adds a record that another replica put into a shared store.
+// Unlike put, the image is added as the least recently used and no other
+// image is evicted to make room for it. Otherwise, the images that this
+// replica evicted would come back whenever the store changes and push out the
+// images that it's using. The lock must be held by the caller.
+func (c *cacheImpl) putLeastRecent(record cacheRecord) {
+	key := record.Image.Digest + platformSuffix(record.Platform)
+	if _, ok := c.imageMap[key]; !ok {
+		if c.maxEntries > 0 && len(c.imageMap) >= c.maxEntries {
+			return
+		}
+		c.elements[key] = c.lru.PushBack(key)
+	}
+
+	c.digestMap[record.Ref] = record.Image.Digest
+	c.resolved[record.Ref] = record.Time
+	if _, ok := c.referenced[record.Ref]; !ok {
+		c.referenced[record.Ref] = time.Now()
+	}
+	c.imageMap[key] = &CachedContainerImage{
+		ContainerImage: record.Image,
+		Time:           record.Time,
+	}
+
+	cacheEntries.Set(float64(len(c.imageMap)))
+}
+
+// records returns every entry in the cache
+func (c *cacheImpl) records() []cacheRecord {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	refs := map[string][]string{}
+	for ref, digest := range c.digestMap {
+		refs[digest] = append(refs[digest], ref)
+	}
+
+	var records []cacheRecord
+	for key, img := range c.imageMap {
+		digest, platform, _ := strings.Cut(key, "|")
+		for _, ref := range refs[digest] {
+			records = append(records, cacheRecord{
+				Ref:      ref,
+				Platform: platform,
+				Image:    img.ContainerImage,
+				Time:     c.withResolved(ref, img).Time,
+			})
+		}
+	}
+
+	return records
+}
+
+// cacheRecord is an entry in the cache, in a form that can be persisted
+type cacheRecord struct {
+	Ref      string          `json:"ref"`
+	Platform string          `json:"platform,omitempty"`
+	Image    *ContainerImage `json:"image"`
+	Time     time.Time       `json:"time"`
+}
+
+func newCacheRecord(ref name.Reference, platform *v1.Platform, img *ContainerImage, t time.Time) cacheRecord {
+	record := cacheRecord{
+		Ref:   ref.String(),
+		Image: img,
+		Time:  t,
+	}
+	if platform != nil {
+		record.Platform = platform.String()
+	}
+
+	return record
+}
+
+// imageKey is the key for an image in the cache. The same digest can resolve
+// to a different image for each platform when it refers to an index.
+func imageKey(digest string, platform *v1.Platform) string {
+	if platform == nil {
+		return digest
+	}
+
+	return digest + platformSuffix(platform.String())
+}
+
+func platformSuffix(platform string) string {
+	if platform == "" {
+		return ""
+	}
+
+	return "|" + platform
+}
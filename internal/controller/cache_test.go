@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestCachePruneKeepsIndexImages(t *testing.T) {
+	ctx := context.Background()
+	c := NewContainerImageCache().(*cacheImpl)
+
+	platform := v1.Platform{OS: "linux", Architecture: "arm64"}
+	parent := name.MustParseReference("registry.example.com/app:latest")
+	child := parent.Context().Digest("sha256:2")
+	if err := c.Put(ctx, parent, nil, &ContainerImage{
+		Digest:    "sha256:1",
+		Manifests: []PlatformManifest{{Digest: "sha256:2", Platform: platform}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, child, &platform, &ContainerImage{Digest: "sha256:2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the index is in use, but the images in it are kept and
+	// persisted once the grace period has passed
+	time.Sleep(time.Millisecond)
+	if err := c.Prune(ctx, []name.Reference{parent}, time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, child, &platform); err != nil {
+		t.Fatalf("expected the image in the index to be cached: %s", err)
+	}
+	if records := c.records(); len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	// The images in the index are removed with it
+	time.Sleep(time.Millisecond)
+	if err := c.Prune(ctx, nil, time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	if records := c.records(); len(records) != 0 {
+		t.Fatalf("expected 0 records, got %d", len(records))
+	}
+}
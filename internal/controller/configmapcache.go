@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// configMapCacheComponent is the value of the component label on the
+	// ConfigMaps that hold the cache
+	configMapCacheComponent = "cache"
+
+	// maxConfigMapCacheSize is the maximum size of the data in each shard.
+	// This leaves some headroom under the 1MiB limit on the size of a
+	// ConfigMap for the metadata.
+	maxConfigMapCacheSize = 900 * 1024
+)
+
+// configMapCache is an in-memory cache that is shared between replicas by
+// storing every entry in ConfigMaps. The entries are sharded across a number
+// of ConfigMaps to keep each of them under the size limit, and the oldest
+// entries in a shard are evicted when it's full.
+type configMapCache struct {
+	*cacheImpl
+
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	shards    int
+}
+
+// NewConfigMapContainerImageCache returns a cache which is stored in sharded
+// ConfigMaps in the namespace, so that it can be shared by multiple replicas.
+// The ConfigMaps are watched until the context is cancelled and any entries
+// put into the cache by other replicas are loaded into memory.
+func NewConfigMapContainerImageCache(ctx context.Context, client kubernetes.Interface, namespace, name string, shards int, opts ...CacheOption) (ContainerImageCache, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("shards must be greater than 0")
+	}
+
+	c := &configMapCache{
+		cacheImpl: NewContainerImageCache(opts...).(*cacheImpl),
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		shards:    shards,
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		client,
+		0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = "app.kubernetes.io/component=" + configMapCacheComponent
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.load,
+		UpdateFunc: func(_, obj interface{}) {
+			c.load(obj)
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("adding event handler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	for typ, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return nil, fmt.Errorf("waiting for %s informer to sync", typ)
+		}
+	}
+
+	return c, nil
+}
+
+// Put an image into the cache and store it in the ConfigMap for its shard.
+// The ConfigMaps are only shared on a best-effort basis, so a failure to
+// store the record is logged rather than failing the Put.
+func (c *configMapCache) Put(ctx context.Context, ref name.Reference, platform *v1.Platform, img *ContainerImage) error {
+	if img == nil {
+		return nil
+	}
+
+	record := newCacheRecord(ref, platform, img, time.Now())
+
+	c.cacheImpl.lock.Lock()
+	existing := c.get(record.Ref, record.Platform)
+	c.put(record)
+	c.cacheImpl.lock.Unlock()
+
+	// Revalidating a tag that still resolves to the same image only
+	// changes the time, which isn't worth an update that every replica
+	// has to load
+	if existing != nil && existing.ContainerImage == img {
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding cache record: %w", err)
+	}
+	key := recordKey(record)
+	shard := c.shardName(key)
+	if err := c.update(ctx, shard, func(cm *corev1.ConfigMap) {
+		setConfigMapRecord(cm, key, string(data))
+	}); err != nil {
+		ctrl.Log.Error(err, "Failed to store cache record", "configmap", shard, "ref", record.Ref)
+	}
+
+	return nil
+}
+
+// Prune removes unused entries from the cache and deletes them from the
+// ConfigMaps
+func (c *configMapCache) Prune(ctx context.Context, inUse []name.Reference, grace time.Duration) error {
+	before := c.records()
+
+	c.cacheImpl.lock.Lock()
+	evicted := c.prune(inUse, grace)
+	c.cacheImpl.lock.Unlock()
+
+	if evicted == 0 {
+		return nil
+	}
+
+	remaining := map[string]struct{}{}
+	for _, record := range c.records() {
+		remaining[recordKey(record)] = struct{}{}
+	}
+	removed := map[string][]string{}
+	for _, record := range before {
+		key := recordKey(record)
+		if _, ok := remaining[key]; ok {
+			continue
+		}
+		shard := c.shardName(key)
+		removed[shard] = append(removed[shard], key)
+	}
+
+	for shard, keys := range removed {
+		err := c.update(ctx, shard, func(cm *corev1.ConfigMap) {
+			for _, key := range keys {
+				delete(cm.Data, key)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// update applies the mutation to the latest version of the ConfigMap for a
+// shard, creating it if it doesn't exist
+func (c *configMapCache) update(ctx context.Context, shard string, mutate func(cm *corev1.ConfigMap)) error {
+	// Another replica may update the same shard at the same time, in which
+	// case the update is retried against the latest version
+	isRetryable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	err := retry.OnError(retry.DefaultRetry, isRetryable, func() error {
+		cm, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(ctx, shard, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = c.newConfigMap(shard)
+			mutate(cm)
+			_, err = c.client.CoreV1().ConfigMaps(c.namespace).Create(ctx, cm, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		mutate(cm)
+		_, err = c.client.CoreV1().ConfigMaps(c.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("updating cache configmap %s/%s: %w", c.namespace, shard, err)
+	}
+
+	return nil
+}
+
+// load puts the records in a ConfigMap into memory, unless there's a more
+// recent record in memory already. The records are added as the least
+// recently used, so they don't displace the images this replica is using.
+func (c *configMapCache) load(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	c.cacheImpl.lock.Lock()
+	defer c.cacheImpl.lock.Unlock()
+
+	for key, data := range cm.Data {
+		var record cacheRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil || record.Image == nil {
+			ctrl.Log.Info("Skipping invalid cache record", "configmap", cm.Name, "key", key)
+			continue
+		}
+		if existing := c.get(record.Ref, record.Platform); existing != nil && !existing.Time.Before(record.Time) {
+			continue
+		}
+		c.putLeastRecent(record)
+	}
+}
+
+func (c *configMapCache) shardName(key string) string {
+	shard, _ := hex.DecodeString(key[:2])
+
+	return fmt.Sprintf("%s-%d", c.name, int(shard[0])%c.shards)
+}
+
+func (c *configMapCache) newConfigMap(name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: c.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":      "container-image-exporter",
+				"app.kubernetes.io/component": configMapCacheComponent,
+			},
+		},
+	}
+}
+
+// setConfigMapRecord sets the record in the ConfigMap, evicting the oldest
+// records until the data fits under the size limit
+func setConfigMapRecord(cm *corev1.ConfigMap, key, data string) {
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[key] = data
+
+	size := 0
+	for k, v := range cm.Data {
+		size += len(k) + len(v)
+	}
+	if size <= maxConfigMapCacheSize {
+		return
+	}
+
+	type entry struct {
+		key  string
+		size int
+		time time.Time
+	}
+	var entries []entry
+	for k, v := range cm.Data {
+		if k == key {
+			continue
+		}
+		var record cacheRecord
+		_ = json.Unmarshal([]byte(v), &record)
+		entries = append(entries, entry{key: k, size: len(k) + len(v), time: record.Time})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return a.time.Compare(b.time)
+	})
+	for _, e := range entries {
+		if size <= maxConfigMapCacheSize {
+			break
+		}
+		delete(cm.Data, e.key)
+		size -= e.size
+	}
+}
+
+// recordKey is the key for a record in a ConfigMap. Keys in a ConfigMap are
+// restricted to a small set of characters, so the reference and platform are
+// hashed.
+func recordKey(record cacheRecord) string {
+	h := sha256.Sum256([]byte(record.Ref + platformSuffix(record.Platform)))
+
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestConfigMapCacheLoadDoesNotEvict(t *testing.T) {
+	ctx := context.Background()
+	c := &configMapCache{
+		cacheImpl: NewContainerImageCache(WithMaxEntries(1)).(*cacheImpl),
+	}
+
+	inUse := name.MustParseReference("registry.example.com/in-use:latest")
+	c.cacheImpl.lock.Lock()
+	c.put(newCacheRecord(inUse, nil, &ContainerImage{Digest: "sha256:1"}, time.Now()))
+	c.cacheImpl.lock.Unlock()
+
+	// Another replica stores an image that this replica evicted, or never
+	// had room for
+	evicted := name.MustParseReference("registry.example.com/evicted:latest")
+	record := newCacheRecord(evicted, nil, &ContainerImage{Digest: "sha256:2"}, time.Now())
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.load(&corev1.ConfigMap{Data: map[string]string{recordKey(record): string(data)}})
+
+	if _, err := c.Get(ctx, inUse, nil); err != nil {
+		t.Errorf("expected the image in use to stay in the cache: %s", err)
+	}
+	if _, err := c.Get(ctx, evicted, nil); err == nil {
+		t.Errorf("expected the loaded image not to displace the image in use")
+	}
+}
+
+func TestConfigMapCachePut(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	c := &configMapCache{
+		cacheImpl: NewContainerImageCache().(*cacheImpl),
+		client:    client,
+		namespace: "default",
+		name:      "cache",
+		shards:    1,
+	}
+
+	ref := name.MustParseReference("registry.example.com/app:latest")
+	img := &ContainerImage{Digest: "sha256:1"}
+	if err := c.Put(ctx, ref, nil, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().ConfigMaps("default").Get(ctx, "cache-0", metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the record to be stored: %s", err)
+	}
+
+	// Revalidating the tag doesn't write to the ConfigMap again
+	client.ClearActions()
+	if err := c.Put(ctx, ref, nil, img); err != nil {
+		t.Fatal(err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("expected no requests when only the time changed, got %d", len(actions))
+	}
+
+	// A failure to store the record doesn't fail the Put, and the record
+	// is still cached in memory
+	client.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(corev1.Resource("configmaps"), "cache-0", fmt.Errorf("denied"))
+	})
+	other := name.MustParseReference("registry.example.com/other:latest")
+	if err := c.Put(ctx, other, nil, &ContainerImage{Digest: "sha256:2"}); err != nil {
+		t.Fatalf("expected the Put to succeed: %s", err)
+	}
+	if _, err := c.Get(ctx, other, nil); err != nil {
+		t.Fatalf("expected the record to be cached in memory: %s", err)
+	}
+}
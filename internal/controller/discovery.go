@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// discoveredController is a controller that was started for a discovered
+// custom resource
+type discoveredController struct {
+	resource Resource
+	cancel   context.CancelFunc
+}
+
+// CustomResourceDiscoverer watches CustomResourceDefinitions and starts a
+// ContainerImageReconciler for every custom resource with a schema that embeds
+// a pod spec. The reconciler is stopped again when the definition is deleted.
+type CustomResourceDiscoverer struct {
+	mgr           manager.Manager
+	resources     *resourceSet
+	snapshot      *snapshot
+	newReconciler func(Resource) reconcile.Reconciler
+
+	ctx         context.Context
+	controllers map[string]*discoveredController
+	lock        sync.Mutex
+}
+
+// Start runs the controller that watches CustomResourceDefinitions. The
+// context is kept so that the controllers for discovered resources are
+// stopped when the manager stops.
+func (d *CustomResourceDiscoverer) Start(ctx context.Context) error {
+	d.lock.Lock()
+	d.ctx = ctx
+	d.lock.Unlock()
+
+	c, err := controller.NewUnmanaged("customresourcedefinition", controller.Options{
+		Reconciler: d,
+	})
+	if err != nil {
+		return fmt.Errorf("creating controller: %w", err)
+	}
+	if err := c.Watch(source.Kind(d.mgr.GetCache(), &apiextensionsv1.CustomResourceDefinition{}, &handler.TypedEnqueueRequestForObject[*apiextensionsv1.CustomResourceDefinition]{})); err != nil {
+		return fmt.Errorf("watching custom resource definitions: %w", err)
+	}
+
+	return c.Start(ctx)
+}
+
+// Reconcile starts, restarts or stops the controller for the custom resource
+// defined by a CustomResourceDefinition
+func (d *CustomResourceDiscoverer) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := ctrl.Log.WithValues("customresourcedefinition", req.Name)
+
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := d.mgr.GetClient().Get(ctx, req.NamespacedName, crd); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, err
+		}
+		crd = nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var resource *Resource
+	if crd != nil && crd.DeletionTimestamp.IsZero() && isEstablished(crd) {
+		resource = podSpecResource(crd)
+	}
+
+	if existing, ok := d.controllers[req.Name]; ok {
+		if resource != nil && existing.resource.GroupVersionKind() == resource.GroupVersionKind() && slices.Equal(existing.resource.PodSpecPaths, resource.PodSpecPaths) && existing.resource.DesiredReplicasPath == resource.DesiredReplicasPath {
+			return ctrl.Result{}, nil
+		}
+		logger.Info("Stopping controller for custom resource", "gvk", existing.resource.GroupVersionKind())
+		if err := d.stop(ctx, req.Name); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if resource == nil {
+		return ctrl.Result{}, nil
+	}
+
+	// Statically configured resources take precedence over discovered
+	// ones
+	if d.resources.hasGroupKind(resource.GroupVersionKind().GroupKind()) {
+		return ctrl.Result{}, nil
+	}
+
+	logger.Info("Starting controller for custom resource", "gvk", resource.GroupVersionKind(), "pod_spec_paths", resource.PodSpecPaths)
+	if err := d.start(req.Name, *resource); err != nil {
+		return ctrl.Result{}, fmt.Errorf("starting controller for %s: %w", resource.GroupVersionKind(), err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// start runs a controller for the resource defined by the named custom
+// resource definition. The lock must be held by the caller.
+func (d *CustomResourceDiscoverer) start(name string, resource Resource) error {
+	c, err := controller.NewUnmanaged(resource.controllerName(), controller.Options{
+		Reconciler: d.newReconciler(resource),
+		// The same resource may be started and stopped multiple times
+		// over the life of the process
+		SkipNameValidation: ptr.To(true),
+	})
+	if err != nil {
+		return fmt.Errorf("creating controller: %w", err)
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(resource.GroupVersionKind())
+	if err := c.Watch(source.Kind(d.mgr.GetCache(), obj, &handler.TypedEnqueueRequestForObject[*unstructured.Unstructured]{})); err != nil {
+		return fmt.Errorf("watching %s: %w", resource.GroupVersionKind(), err)
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	go func() {
+		if err := c.Start(ctx); err != nil {
+			ctrl.Log.Error(err, "Controller for custom resource stopped", "gvk", resource.GroupVersionKind())
+		}
+	}()
+
+	d.controllers[name] = &discoveredController{
+		resource: resource,
+		cancel:   cancel,
+	}
+	d.resources.add(resource)
+
+	return nil
+}
+
+// stop stops the controller for the custom resource definition and the
+// informer that backs it. The lock must be held by the caller.
+func (d *CustomResourceDiscoverer) stop(ctx context.Context, name string) error {
+	existing, ok := d.controllers[name]
+	if !ok {
+		return nil
+	}
+
+	d.resources.remove(existing.resource.GroupVersionKind())
+	d.snapshot.deleteKind(existing.resource.GroupVersionKind())
+	existing.cancel()
+	delete(d.controllers, name)
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(existing.resource.GroupVersionKind())
+	if err := d.mgr.GetCache().RemoveInformer(ctx, obj); err != nil {
+		return fmt.Errorf("removing informer for %s: %w", existing.resource.GroupVersionKind(), err)
+	}
+
+	return nil
+}
+
+func isEstablished(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	for _, cond := range crd.Status.Conditions {
+		if cond.Type == apiextensionsv1.Established {
+			return cond.Status == apiextensionsv1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// podSpecResource returns a Resource for the storage version of the custom
+// resource if its schema contains any pod specs, or nil if it doesn't
+func podSpecResource(crd *apiextensionsv1.CustomResourceDefinition) *Resource {
+	for _, version := range crd.Spec.Versions {
+		if !version.Storage || !version.Served {
+			continue
+		}
+		if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			return nil
+		}
+
+		var paths []string
+		findPodSpecPaths(*version.Schema.OpenAPIV3Schema, nil, &paths)
+		if len(paths) == 0 {
+			return nil
+		}
+		slices.Sort(paths)
+
+		resource := &Resource{
+			Group:        crd.Spec.Group,
+			Version:      version.Name,
+			Kind:         crd.Spec.Names.Kind,
+			PodSpecPaths: paths,
+		}
+
+		// The scale subresource says where the desired replicas are.
+		// It only describes the total replicas in the status, not how
+		// many are ready.
+		if version.Subresources != nil && version.Subresources.Scale != nil {
+			resource.DesiredReplicasPath = strings.TrimPrefix(version.Subresources.Scale.SpecReplicasPath, ".")
+		}
+
+		return resource
+	}
+
+	return nil
+}
+
+// findPodSpecPaths walks the properties in a schema looking for objects that
+// are shaped like a pod spec. Paths that pass through arrays are ignored
+// because the container paths can't address them.
+func findPodSpecPaths(schema apiextensionsv1.JSONSchemaProps, path []string, paths *[]string) {
+	if len(path) > 0 && isPodSpec(schema) {
+		*paths = append(*paths, strings.Join(path, "."))
+		return
+	}
+
+	for name, prop := range schema.Properties {
+		findPodSpecPaths(prop, appendPath(path, name), paths)
+	}
+}
+
+// isPodSpec returns true if the schema has a containers field that holds an
+// array of objects with a name and an image
+func isPodSpec(schema apiextensionsv1.JSONSchemaProps) bool {
+	containers, ok := schema.Properties["containers"]
+	if !ok || containers.Type != "array" || containers.Items == nil || containers.Items.Schema == nil {
+		return false
+	}
+	_, hasName := containers.Items.Schema.Properties["name"]
+	_, hasImage := containers.Items.Schema.Properties["image"]
+
+	return hasName && hasImage
+}
@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// The reasons that an image can fail to resolve
+const (
+	reasonNotFound         = "not_found"
+	reasonUnauthorized     = "unauthorized"
+	reasonDenied           = "denied"
+	reasonRateLimited      = "rate_limited"
+	reasonTimeout          = "timeout"
+	reasonInvalidReference = "invalid_reference"
+	reasonTLS              = "tls"
+	reasonUnknown          = "unknown"
+)
+
+const (
+	// minErrorBackoff is how long to wait before retrying an image that
+	// failed with a permanent error for the first time
+	minErrorBackoff = 30 * time.Second
+
+	// maxErrorBackoff is the longest we'll wait before retrying an image
+	// that failed with a permanent error
+	maxErrorBackoff = 5 * time.Minute
+)
+
+// errorReason classifies the error returned when resolving an image
+func errorReason(err error) string {
+	if name.IsErrBadName(err) {
+		return reasonInvalidReference
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		for _, diagnostic := range terr.Errors {
+			switch diagnostic.Code {
+			case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode, transport.BlobUnknownErrorCode:
+				return reasonNotFound
+			case transport.UnauthorizedErrorCode:
+				return reasonUnauthorized
+			case transport.DeniedErrorCode:
+				return reasonDenied
+			case transport.TooManyRequestsErrorCode:
+				return reasonRateLimited
+			case transport.NameInvalidErrorCode, transport.TagInvalidErrorCode:
+				return reasonInvalidReference
+			}
+		}
+		switch terr.StatusCode {
+		case http.StatusNotFound:
+			return reasonNotFound
+		case http.StatusUnauthorized:
+			return reasonUnauthorized
+		case http.StatusForbidden:
+			return reasonDenied
+		case http.StatusTooManyRequests:
+			return reasonRateLimited
+		case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+			return reasonTimeout
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return reasonTimeout
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return reasonTimeout
+	}
+
+	var (
+		unknownAuthorityErr   x509.UnknownAuthorityError
+		certificateInvalidErr x509.CertificateInvalidError
+		hostnameErr           x509.HostnameError
+		verificationErr       *tls.CertificateVerificationError
+		recordHeaderErr       tls.RecordHeaderError
+	)
+	if errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &verificationErr) ||
+		errors.As(err, &recordHeaderErr) {
+		return reasonTLS
+	}
+
+	return reasonUnknown
+}
+
+// isPermanentReason returns true if an image that failed for the reason is
+// unlikely to resolve if it's retried straight away
+func isPermanentReason(reason string) bool {
+	switch reason {
+	case reasonNotFound, reasonUnauthorized, reasonDenied, reasonInvalidReference, reasonTLS:
+		return true
+	}
+
+	return false
+}
+
+// isAuthReason returns true if the image failed to resolve because of the
+// credentials it was fetched with
+func isAuthReason(reason string) bool {
+	return reason == reasonUnauthorized || reason == reasonDenied
+}
+
+// resolutionError is the most recent error for an image
+type resolutionError struct {
+	Err      error
+	Reason   string
+	Failures int
+	Time     time.Time
+}
+
+// backoff returns how long to wait before retrying the image, doubling with
+// each consecutive failure
+func (e resolutionError) backoff() time.Duration {
+	d := minErrorBackoff
+	for i := 1; i < e.Failures && d < maxErrorBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, maxErrorBackoff)
+}
+
+// resolutionErrors records the images that failed to resolve, so that they
+// can be reported separately from the images that resolved successfully.
+// Objects can fetch the same image with different credentials, so errors are
+// recorded for each keychain that the image was fetched with.
+type resolutionErrors struct {
+	errors map[resolutionErrorKey]resolutionError
+	lock   sync.RWMutex
+}
+
+// resolutionErrorKey is an image and the identity of the keychain it was
+// fetched with
+type resolutionErrorKey struct {
+	image    string
+	keychain string
+}
+
+func newResolutionErrors() *resolutionErrors {
+	return &resolutionErrors{
+		errors: map[resolutionErrorKey]resolutionError{},
+	}
+}
+
+// set records an error for an image fetched with the keychain and returns it
+func (r *resolutionErrors) set(image, keychain string, err error) resolutionError {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := resolutionErrorKey{image: image, keychain: keychain}
+	rerr := resolutionError{
+		Err:      err,
+		Reason:   errorReason(err),
+		Failures: r.errors[key].Failures + 1,
+		Time:     time.Now(),
+	}
+	r.errors[key] = rerr
+
+	var registry string
+	if ref, err := name.ParseReference(image); err == nil {
+		registry = ref.Context().RegistryStr()
+	}
+	resolutionFailures.WithLabelValues(registry).Inc()
+
+	return rerr
+}
+
+// clear removes the error for an image fetched with the keychain after it
+// resolves successfully
+func (r *resolutionErrors) clear(image, keychain string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.errors, resolutionErrorKey{image: image, keychain: keychain})
+}
+
+// reasons returns the distinct reasons that an image failed to resolve, with
+// any of the keychains it was fetched with
+func (r *resolutionErrors) reasons(image string) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var reasons []string
+	for key, rerr := range r.errors {
+		if key.image == image && !slices.Contains(reasons, rerr.Reason) {
+			reasons = append(reasons, rerr.Reason)
+		}
+	}
+	slices.Sort(reasons)
+
+	return reasons
+}
+
+// retain removes the errors for any image that isn't in the set of images
+func (r *resolutionErrors) retain(images map[string]struct{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key := range r.errors {
+		if _, ok := images[key.image]; !ok {
+			delete(r.errors, key)
+		}
+	}
+}
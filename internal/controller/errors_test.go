@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestErrorReason(t *testing.T) {
+	_, badName := name.ParseReference("Registry.Example.com/App:")
+	if badName == nil {
+		t.Fatal("expected the reference to be invalid")
+	}
+
+	// withCodes returns the error for a response with a body that lists
+	// the codes, like the response to a GET request
+	withCodes := func(status int, codes ...transport.ErrorCode) error {
+		terr := &transport.Error{StatusCode: status}
+		for _, code := range codes {
+			terr.Errors = append(terr.Errors, transport.Diagnostic{Code: code})
+		}
+		return terr
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "invalid reference", err: badName, want: reasonInvalidReference},
+		{name: "manifest unknown", err: withCodes(http.StatusNotFound, transport.ManifestUnknownErrorCode), want: reasonNotFound},
+		{name: "name unknown", err: withCodes(http.StatusNotFound, transport.NameUnknownErrorCode), want: reasonNotFound},
+		{name: "blob unknown", err: withCodes(http.StatusNotFound, transport.BlobUnknownErrorCode), want: reasonNotFound},
+		{name: "name invalid", err: withCodes(http.StatusBadRequest, transport.NameInvalidErrorCode), want: reasonInvalidReference},
+		{name: "tag invalid", err: withCodes(http.StatusBadRequest, transport.TagInvalidErrorCode), want: reasonInvalidReference},
+		{name: "too many requests", err: withCodes(http.StatusTooManyRequests, transport.TooManyRequestsErrorCode), want: reasonRateLimited},
+		// Registries like Docker Hub return 401 for repositories that
+		// don't exist, so the code in the body takes precedence
+		{name: "unauthorized", err: withCodes(http.StatusUnauthorized, transport.UnauthorizedErrorCode), want: reasonUnauthorized},
+		{name: "denied with unauthorized status", err: withCodes(http.StatusUnauthorized, transport.DeniedErrorCode), want: reasonDenied},
+		{name: "unknown code falls back to status", err: withCodes(http.StatusNotFound, transport.UnknownErrorCode), want: reasonNotFound},
+		{name: "first known code wins", err: withCodes(http.StatusUnauthorized, transport.UnsupportedErrorCode, transport.UnauthorizedErrorCode, transport.DeniedErrorCode), want: reasonUnauthorized},
+		// The response to a HEAD request doesn't have a body, so only
+		// the status code is available
+		{name: "HEAD not found", err: withCodes(http.StatusNotFound), want: reasonNotFound},
+		{name: "HEAD unauthorized", err: withCodes(http.StatusUnauthorized), want: reasonUnauthorized},
+		{name: "HEAD forbidden", err: withCodes(http.StatusForbidden), want: reasonDenied},
+		{name: "HEAD too many requests", err: withCodes(http.StatusTooManyRequests), want: reasonRateLimited},
+		{name: "HEAD request timeout", err: withCodes(http.StatusRequestTimeout), want: reasonTimeout},
+		{name: "HEAD gateway timeout", err: withCodes(http.StatusGatewayTimeout), want: reasonTimeout},
+		{name: "HEAD server error", err: withCodes(http.StatusInternalServerError), want: reasonUnknown},
+		{name: "wrapped transport error", err: fmt.Errorf("fetching image: %w", withCodes(http.StatusNotFound)), want: reasonNotFound},
+		{name: "deadline exceeded", err: fmt.Errorf("fetching image: %w", context.DeadlineExceeded), want: reasonTimeout},
+		{name: "unknown authority", err: fmt.Errorf("fetching image: %w", x509.UnknownAuthorityError{}), want: reasonTLS},
+		{name: "hostname mismatch", err: fmt.Errorf("fetching image: %w", x509.HostnameError{Certificate: &x509.Certificate{}, Host: "registry.example.com"}), want: reasonTLS},
+		{name: "certificate invalid", err: x509.CertificateInvalidError{Cert: &x509.Certificate{}, Reason: x509.Expired}, want: reasonTLS},
+		{name: "certificate verification", err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, want: reasonTLS},
+		{name: "plain HTTP to a TLS registry", err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, want: reasonTLS},
+		{name: "cancelled", err: context.Canceled, want: reasonUnknown},
+		{name: "other error", err: errors.New("connection reset by peer"), want: reasonUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorReason(tt.err); got != tt.want {
+				t.Errorf("errorReason() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPermanentReason(t *testing.T) {
+	tests := map[string]bool{
+		reasonNotFound:         true,
+		reasonUnauthorized:     true,
+		reasonDenied:           true,
+		reasonInvalidReference: true,
+		reasonTLS:              true,
+		reasonRateLimited:      false,
+		reasonTimeout:          false,
+		reasonUnknown:          false,
+	}
+	for reason, want := range tests {
+		if got := isPermanentReason(reason); got != want {
+			t.Errorf("isPermanentReason(%s) = %t, want %t", reason, got, want)
+		}
+	}
+}
+
+func TestResolutionErrorBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: minErrorBackoff},
+		{failures: 2, want: 2 * minErrorBackoff},
+		{failures: 3, want: 4 * minErrorBackoff},
+		{failures: 4, want: 8 * minErrorBackoff},
+		{failures: 5, want: maxErrorBackoff},
+		{failures: 100, want: maxErrorBackoff},
+	}
+	for _, tt := range tests {
+		if got := (resolutionError{Failures: tt.failures}).backoff(); got != tt.want {
+			t.Errorf("backoff() with %d failures = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestResolutionErrorsByKeychain(t *testing.T) {
+	image := "registry.example.com/app:latest"
+	unauthorized := &transport.Error{StatusCode: http.StatusUnauthorized}
+	notFound := &transport.Error{StatusCode: http.StatusNotFound}
+
+	r := newResolutionErrors()
+	r.set(image, "team-a/default/", unauthorized)
+	r.set(image, "team-b/default/", notFound)
+	r.set(image, "team-c/default/", notFound)
+
+	// Each reason is reported once, whichever keychains it failed with
+	if got, want := r.reasons(image), []string{reasonNotFound, reasonUnauthorized}; !slices.Equal(got, want) {
+		t.Fatalf("reasons = %v, want %v", got, want)
+	}
+
+	// The image resolving with one keychain doesn't clear the errors for
+	// the others
+	r.clear(image, "team-b/default/")
+	r.clear(image, "team-c/default/")
+	if got, want := r.reasons(image), []string{reasonUnauthorized}; !slices.Equal(got, want) {
+		t.Fatalf("reasons = %v, want %v", got, want)
+	}
+
+	// Failures are counted for each keychain
+	if rerr := r.set(image, "team-a/default/", unauthorized); rerr.Failures != 2 {
+		t.Errorf("expected 2 failures, got %d", rerr.Failures)
+	}
+	if rerr := r.set(image, "team-b/default/", unauthorized); rerr.Failures != 1 {
+		t.Errorf("expected 1 failure, got %d", rerr.Failures)
+	}
+
+	r.retain(map[string]struct{}{})
+	if got := r.reasons(image); len(got) != 0 {
+		t.Errorf("expected no reasons after the image is no longer used, got %v", got)
+	}
+}
@@ -0,0 +1,205 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// maxRecordSize is the largest record that will be read from a cache file.
+// Images with a lot of labels or annotations can produce long lines.
+const maxRecordSize = 16 * 1024 * 1024
+
+// minCompactRecords is the number of records the file must hold before it's
+// compacted while the exporter is running
+const minCompactRecords = 1000
+
+// fileCache is an in-memory cache that persists every entry to a file, so that
+// the cache survives restarts
+type fileCache struct {
+	*cacheImpl
+
+	path string
+	file *os.File
+
+	// lines is the number of records in the file and compacted is the
+	// number there were after it was last compacted
+	lines     int
+	compacted int
+
+	lock sync.Mutex
+}
+
+// NewFileContainerImageCache returns a cache which is persisted to a file as
+// JSON lines. Any entries already in the file are loaded, along with the time
+// they were cached, and the file is compacted so that it only holds the latest
+// entry for each image.
+func NewFileContainerImageCache(path string, opts ...CacheOption) (ContainerImageCache, error) {
+	c := &fileCache{
+		cacheImpl: NewContainerImageCache(opts...).(*cacheImpl),
+		path:      path,
+	}
+
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("loading cache file: %w", err)
+	}
+	if err := c.rewrite(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Prune removes unused entries from the cache and compacts the file if
+// anything was removed
+func (c *fileCache) Prune(ctx context.Context, inUse []name.Reference, grace time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cacheImpl.lock.Lock()
+	evicted := c.prune(inUse, grace)
+	c.cacheImpl.lock.Unlock()
+
+	if evicted == 0 {
+		return nil
+	}
+
+	return c.rewrite()
+}
+
+// rewrite compacts the file and reopens it for appending. If either step
+// fails, the previous file is kept open so that records can still be appended
+// to it. The lock must be held by the caller.
+func (c *fileCache) rewrite() error {
+	// Don't try again until the file has grown as much as it would have
+	// after a successful compaction
+	c.compacted = c.lines
+
+	n, err := c.compact()
+	if err != nil {
+		return fmt.Errorf("compacting cache file: %w", err)
+	}
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening cache file: %w", err)
+	}
+	if c.file != nil {
+		c.file.Close()
+	}
+	c.file = f
+	c.lines = n
+	c.compacted = n
+
+	return nil
+}
+
+// Put an image into the cache and append it to the file
+func (c *fileCache) Put(ctx context.Context, ref name.Reference, platform *v1.Platform, img *ContainerImage) error {
+	if img == nil {
+		return nil
+	}
+
+	record := newCacheRecord(ref, platform, img, time.Now())
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding cache record: %w", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing to cache file: %w", err)
+	}
+	c.lines++
+
+	c.cacheImpl.lock.Lock()
+	c.put(record)
+	c.cacheImpl.lock.Unlock()
+
+	// Every revalidation of a tag appends a record, so the file is
+	// compacted once most of the records in it have been replaced. The
+	// record is already in the file, so a failure doesn't fail the Put.
+	if c.lines >= 2*max(c.compacted, minCompactRecords) {
+		if err := c.rewrite(); err != nil {
+			ctrl.Log.Error(err, "Failed to compact cache file", "path", c.path)
+		}
+	}
+
+	return nil
+}
+
+// load reads the records in the file into memory. Later records replace
+// earlier ones for the same image. Lines that can't be decoded, such as a
+// partial line written before a crash, are skipped.
+func (c *fileCache) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.cacheImpl.lock.Lock()
+	defer c.cacheImpl.lock.Unlock()
+
+	var loaded, skipped int
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var record cacheRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Image == nil {
+			skipped++
+			continue
+		}
+		c.put(record)
+		loaded++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ctrl.Log.Info("Loaded cache file", "path", c.path, "records", loaded, "skipped", skipped)
+
+	return nil
+}
+
+// compact replaces the file with the records that are currently in memory
+// and returns the number of records that were written
+func (c *fileCache) compact() (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	records := c.records()
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	return len(records), os.Rename(tmp.Name(), c.path)
+}
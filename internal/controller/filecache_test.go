@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestFileCachePutAfterFailedPrune(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "cache")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewFileContainerImageCache(filepath.Join(dir, "cache.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := name.MustParseReference("registry.example.com/app:latest")
+	if err := c.Put(ctx, ref, nil, &ContainerImage{Digest: "sha256:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction fails when the temporary file can't be created
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Prune(ctx, nil, 0); err == nil {
+		t.Fatal("expected compaction to fail")
+	}
+
+	if err := c.Put(ctx, ref, nil, &ContainerImage{Digest: "sha256:2"}); err != nil {
+		t.Fatalf("expected the file to still be open after a failed compaction: %s", err)
+	}
+}
+
+func TestFileCacheCompactsWhileRunning(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+	c, err := NewFileContainerImageCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Revalidating the same tag appends a record each time
+	ref := name.MustParseReference("registry.example.com/app:latest")
+	for range 3 * minCompactRecords {
+		if err := c.Put(ctx, ref, nil, &ContainerImage{Digest: "sha256:1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines >= 2*minCompactRecords {
+		t.Fatalf("expected the file to be compacted, it has %d records", lines)
+	}
+}
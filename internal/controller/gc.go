@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// minCacheCollectionInterval is the shortest interval between cache
+// collections
+const minCacheCollectionInterval = 1 * time.Minute
+
+// cacheCollector periodically removes images from the cache that aren't
+// referenced by any of the objects in the snapshot. References are only removed
+// once they've been unused for the grace period, so that images aren't fetched
+// again when a workload is briefly removed and recreated.
+type cacheCollector struct {
+	snapshot    *snapshot
+	cache       ContainerImageCache
+	gracePeriod time.Duration
+	errors      *resolutionErrors
+}
+
+// Start collects the cache until the context is cancelled
+func (c *cacheCollector) Start(ctx context.Context) error {
+	interval := c.gracePeriod / 2
+	if interval < minCacheCollectionInterval {
+		interval = minCacheCollectionInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := c.collect(ctx); err != nil {
+				ctrl.Log.Error(err, "Failed to collect cache")
+			}
+		}
+	}
+}
+
+// collect prunes the cache of images that aren't in use, along with the
+// errors for those images
+func (c *cacheCollector) collect(ctx context.Context) error {
+	var inUse []name.Reference
+	images := map[string]struct{}{}
+	objects, _ := c.snapshot.list()
+	for _, obj := range objects {
+		for _, container := range obj.containers {
+			for _, image := range []string{container.Image, container.RunningImage} {
+				if image == "" {
+					continue
+				}
+				images[image] = struct{}{}
+				ref, err := name.ParseReference(image)
+				if err != nil {
+					continue
+				}
+				inUse = append(inUse, ref)
+			}
+		}
+	}
+
+	if c.errors != nil {
+		c.errors.retain(images)
+	}
+
+	return c.cache.Prune(ctx, inUse, c.gracePeriod)
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RegistryLimit limits the rate and concurrency of the requests made to a
+// registry
+type RegistryLimit struct {
+	// Host is the registry that the limit applies to, like
+	// index.docker.io
+	Host string `json:"host"`
+
+	// QPS is the number of images that can be fetched from the registry per
+	// second
+	QPS float64 `json:"qps,omitempty"`
+
+	// Burst is the number of images that can be fetched at once before
+	// the QPS limit applies
+	Burst int `json:"burst,omitempty"`
+
+	// MaxInFlight is the number of images that can be fetched from the
+	// registry at the same time
+	MaxInFlight int `json:"maxInFlight,omitempty"`
+}
+
+// Validate the limit
+func (l RegistryLimit) Validate() error {
+	if l.Host == "" {
+		return fmt.Errorf("host must be set")
+	}
+	if l.QPS < 0 {
+		return fmt.Errorf("qps must not be negative")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	if l.MaxInFlight < 0 {
+		return fmt.Errorf("maxInFlight must not be negative")
+	}
+
+	return nil
+}
+
+// registryLimiters limits the requests made to each registry. Every
+// reconciler shares the same limiters, so the limits apply across all of
+// them.
+type registryLimiters struct {
+	defaultLimit RegistryLimit
+	overrides    map[string]RegistryLimit
+	limiters     map[string]*registryLimiter
+	lock         sync.Mutex
+}
+
+func newRegistryLimiters(defaultLimit RegistryLimit, overrides []RegistryLimit) *registryLimiters {
+	l := &registryLimiters{
+		defaultLimit: defaultLimit,
+		overrides:    map[string]RegistryLimit{},
+		limiters:     map[string]*registryLimiter{},
+	}
+	for _, override := range overrides {
+		l.overrides[override.Host] = override
+	}
+
+	return l
+}
+
+// acquire waits until a request can be made to the registry. The returned
+// function must be called once the request has finished.
+func (l *registryLimiters) acquire(ctx context.Context, registry string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	release, err := l.limiter(registry).acquire(ctx)
+	registryLimiterWait.WithLabelValues(registry).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("waiting for the %s rate limiter: %w", registry, err)
+	}
+
+	return release, nil
+}
+
+// limiter returns the limiter for the registry, creating it if it doesn't
+// exist yet
+func (l *registryLimiters) limiter(registry string) *registryLimiter {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if limiter, ok := l.limiters[registry]; ok {
+		return limiter
+	}
+
+	// Anything that isn't set for the registry is taken from the default
+	limit := l.defaultLimit
+	if override, ok := l.overrides[registry]; ok {
+		if override.QPS > 0 {
+			limit.QPS = override.QPS
+		}
+		if override.Burst > 0 {
+			limit.Burst = override.Burst
+		}
+		if override.MaxInFlight > 0 {
+			limit.MaxInFlight = override.MaxInFlight
+		}
+	}
+
+	limiter := newRegistryLimiter(limit)
+	l.limiters[registry] = limiter
+
+	return limiter
+}
+
+// registryLimiter limits the requests to a single registry with a token
+// bucket and a maximum number of requests in flight
+type registryLimiter struct {
+	rate     *rate.Limiter
+	inFlight chan struct{}
+}
+
+func newRegistryLimiter(limit RegistryLimit) *registryLimiter {
+	l := &registryLimiter{}
+	if limit.QPS > 0 {
+		burst := limit.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(limit.QPS))
+		}
+		l.rate = rate.NewLimiter(rate.Limit(limit.QPS), burst)
+	}
+	if limit.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, limit.MaxInFlight)
+	}
+
+	return l
+}
+
+func (l *registryLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.rate != nil {
+		if err := l.rate.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.inFlight == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.inFlight <- struct{}{}:
+		return func() { <-l.inFlight }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
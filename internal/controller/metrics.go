@@ -2,12 +2,10 @@ package controller
 
 import (
 	"context"
-	"fmt"
+	"strings"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/prometheus/client_golang/prometheus"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
@@ -17,145 +15,503 @@ const (
 var (
 	metricContainerInfo = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "container_info"),
-		"img about containers running in the cluster, including the image digest resolved by the exporter.",
-		[]string{"group", "version", "kind", "namespace", "name", "jsonpath", "image", "digest"}, nil,
+		"Details about containers running in the cluster, including the image digest resolved by the exporter and the digest of the image that is running.",
+		[]string{"group", "version", "kind", "namespace", "name", "owner_kind", "owner_name", "current_revision", "jsonpath", "container", "container_type", "source", "image", "tag", "digest", "running_digest", "platform"}, nil,
+	)
+	metricContainerInfoKSM = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "container_info"),
+		"Details about containers running in the cluster, including the image digest resolved by the exporter and the digest of the image that is running.",
+		[]string{"group", "version", "kind", "namespace", "name", "pod", "owner_kind", "owner_name", "current_revision", "jsonpath", "container", "container_type", "source", "image", "tag", "digest", "running_digest", "platform"}, nil,
+	)
+	metricTagDrift = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tag_drift"),
+		"Whether the digest a container is running differs from the digest its tag currently resolves to.",
+		[]string{"group", "version", "kind", "namespace", "name", "owner_kind", "owner_name", "jsonpath", "image", "tag", "running_digest", "latest_digest"}, nil,
+	)
+	metricContainerReplicas = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "container_replicas"),
+		"The number of replicas of the object that defines the container, either desired or ready.",
+		[]string{"group", "version", "kind", "namespace", "name", "owner_kind", "owner_name", "jsonpath", "container", "image", "digest", "platform", "state"}, nil,
+	)
+	metricIndexManifest = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "index_manifest"),
+		"Links the digest of an image index to the digest of the image for each platform in it.",
+		[]string{"digest", "manifest_digest", "os", "architecture", "variant", "os_version"}, nil,
+	)
+	metricIndexInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "index_info"),
+		"Details about image indexes, including the media type of the index.",
+		[]string{"digest", "media_type"}, nil,
+	)
+	metricIndexAnnotation = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "index_annotation"),
+		"Annotations from the image index.",
+		[]string{"digest", "key", "value"}, nil,
+	)
+	metricPlatforms = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "platforms"),
+		"The platforms that are available in an image index.",
+		[]string{"digest", "platform"}, nil,
 	)
 	metricAnnotation = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "annotation"),
 		"Annotations from the image manifest.",
-		[]string{"digest", "key", "value"}, nil,
+		[]string{"digest", "platform", "key", "value"}, nil,
 	)
 	metricLabel = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "label"),
 		"Labels from the image config.",
-		[]string{"digest", "key", "value"}, nil,
+		[]string{"digest", "platform", "key", "value"}, nil,
 	)
 	metricSize = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "size_bytes"),
 		"The size of the image in the registry.",
-		[]string{"digest"}, nil,
+		[]string{"digest", "platform"}, nil,
 	)
 	metricCreated = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "created"),
 		"The created date from the image config. Expressed as a Unix Epoch Time.",
-		[]string{"digest"}, nil,
+		[]string{"digest", "platform"}, nil,
+	)
+	metricResolutionError = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "resolution_error"),
+		"Images that failed to resolve the last time they were fetched from the registry, with the reason they failed.",
+		[]string{"image", "reason"}, nil,
+	)
+	metricSnapshotAge = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_age_seconds"),
+		"How long ago the snapshot of containers that metrics are exported from was last updated.",
+		nil, nil,
 	)
 )
 
+var (
+	cacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_entries",
+		Help:      "The number of images in the cache.",
+	})
+	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_evictions_total",
+		Help:      "The number of images that have been evicted from the cache.",
+	}, []string{"reason"})
+	resolutionFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resolution_failures_total",
+		Help:      "The number of times an image failed to resolve, by registry.",
+	}, []string{"registry"})
+	registryRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registry_requests_total",
+		Help:      "The number of HTTP requests made to registries.",
+	}, []string{"registry", "method", "endpoint", "code"})
+	registryRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "registry_request_duration_seconds",
+		Help:      "How long HTTP requests to registries took to return a response.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"registry", "method", "endpoint"})
+	registryResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registry_response_bytes_total",
+		Help:      "The number of bytes downloaded from registries.",
+	}, []string{"registry", "endpoint"})
+	registryRateLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registry_ratelimit_limit",
+		Help:      "The number of requests allowed in the rate limit window, from the ratelimit-limit header.",
+	}, []string{"registry", "credential"})
+	registryRateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registry_ratelimit_remaining",
+		Help:      "The number of requests remaining in the rate limit window, from the ratelimit-remaining header.",
+	}, []string{"registry", "credential"})
+	registryLimiterWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "registry_limiter_wait_seconds",
+		Help:      "How long image fetches waited for the rate and concurrency limits of the registry.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"registry"})
+)
+
 // Exporter exports metrics about container images in Kubernetes
 type Exporter struct {
-	client client.Client
-	cache  ContainerImageCache
+	cache        ContainerImageCache
+	resources    *resourceSet
+	allPlatforms bool
+	ksmLabels    bool
+
+	// excludeOwnedPods drops Pods that are controlled by an object that
+	// is watched, so that they aren't counted twice
+	excludeOwnedPods bool
+
+	resolutionErrors *resolutionErrors
+	snapshot         *snapshot
 }
 
-// NewExporter constructs a new exporter
-func NewExporter(c client.Client, cache ContainerImageCache) *Exporter {
+// NewExporter constructs a new exporter, configured with the same options as
+// the controllers. Metrics are exported from the snapshot of objects that the
+// controllers maintain.
+func NewExporter(cache ContainerImageCache, opts ...Option) *Exporter {
+	o := newOptions(opts...)
+
 	return &Exporter{
-		client: c,
-		cache:  cache,
+		cache:        cache,
+		resources:    newResourceSet(o.resources),
+		allPlatforms: o.allPlatforms,
+		ksmLabels:    o.ksmLabels,
+
+		excludeOwnedPods: o.excludeOwnedPods,
+
+		resolutionErrors: newResolutionErrors(),
+		snapshot:         newSnapshot(),
 	}
 }
 
 // Describe all the metrics provided by the Exporter
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- metricContainerInfo
+	if e.ksmLabels {
+		ch <- metricContainerInfoKSM
+	} else {
+		ch <- metricContainerInfo
+	}
+	ch <- metricTagDrift
+	ch <- metricContainerReplicas
+	ch <- metricIndexManifest
+	ch <- metricIndexInfo
+	ch <- metricIndexAnnotation
+	ch <- metricPlatforms
 	ch <- metricAnnotation
 	ch <- metricLabel
 	ch <- metricSize
 	ch <- metricCreated
+	ch <- metricResolutionError
+	ch <- metricSnapshotAge
 }
 
 // Collect metrics
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	ctx := context.Background()
 
-	digests := map[string]struct{}{}
-	for _, resource := range resources {
-		ul := &unstructured.UnstructuredList{}
-		ul.SetGroupVersionKind(resource.GroupVersionKind)
+	objects, age := e.snapshot.list()
+	ch <- prometheus.MustNewConstMetric(
+		metricSnapshotAge, prometheus.GaugeValue, age.Seconds(),
+	)
 
-		if err := e.client.List(context.Background(), ul); err != nil {
-			return
+	digests := map[string]struct{}{}
+	errImages := map[string]struct{}{}
+	for _, obj := range objects {
+		// Skip objects of kinds that are no longer watched
+		if !e.resources.hasGroupKind(obj.gvk.GroupKind()) {
+			continue
 		}
+		if e.excludeOwnedPods && isPod(obj.gvk) && obj.owner != nil && e.resources.hasGroupKind(obj.owner.GroupKind) {
+			continue
+		}
+		ownerKind, ownerName := obj.owner.labels()
 
-		for _, item := range ul.Items {
-			for _, container := range containerSpecs(&item) {
-				// Fetch image from the cache
-				var digestStr string
-				img, err := e.fetchImage(ctx, container.Image)
-				if err == nil {
-					digestStr = img.Digest
-				}
+		for _, container := range obj.containers {
+			var digestStr, platformStr string
+			img := container.image
+			if img != nil {
+				digestStr = img.Digest
+				platformStr = img.Platform
+			}
+
+			// The running digest is taken from the container status,
+			// so it's known even if its metadata can't be fetched
+			runningDigestStr := container.runningDigest()
+			runningImg := container.runningImage
 
+			ch <- e.containerInfo(obj, ownerKind, ownerName, container, digestStr, runningDigestStr, platformStr)
+
+			// Weight the container by the number of replicas of the
+			// object, for the kinds that have them
+			for state, n := range obj.replicas {
 				ch <- prometheus.MustNewConstMetric(
-					metricContainerInfo,
+					metricContainerReplicas,
 					prometheus.GaugeValue,
-					1.0,
-					item.GroupVersionKind().Group,
-					item.GroupVersionKind().Version,
-					item.GroupVersionKind().Kind,
-					item.GetNamespace(),
-					item.GetName(),
+					float64(n),
+					obj.gvk.Group,
+					obj.gvk.Version,
+					obj.gvk.Kind,
+					obj.Namespace,
+					obj.Name,
+					ownerKind,
+					ownerName,
 					container.JSONPath,
+					container.Name,
 					container.Image,
 					digestStr,
+					platformStr,
+					state,
 				)
+			}
 
-				// We can only collect image-specific metrics if
-				// we could fetch the image metadata
+			// Compare the running digest to the digest that the tag
+			// currently resolves to. The runtime may report the
+			// digest of the platform image rather than the index.
+			if isTag(container.Image) && digestStr != "" && runningDigestStr != "" {
+				drift := 1.0
+				if digestStr == runningDigestStr || img.hasManifest(runningDigestStr) {
+					drift = 0
+				}
+				ch <- prometheus.MustNewConstMetric(
+					metricTagDrift,
+					prometheus.GaugeValue,
+					drift,
+					obj.gvk.Group,
+					obj.gvk.Version,
+					obj.gvk.Kind,
+					obj.Namespace,
+					obj.Name,
+					ownerKind,
+					ownerName,
+					container.JSONPath,
+					container.Image,
+					imageTag(container.Image),
+					runningDigestStr,
+					digestStr,
+				)
+			}
+
+			// Report why the image failed to resolve the last time it
+			// was fetched
+			e.collectResolutionError(ch, container.Image, errImages)
+
+			// We can only collect image-specific metrics if we could
+			// fetch the image metadata
+			for _, img := range []*ContainerImage{img, runningImg} {
 				if img == nil {
 					continue
 				}
 
-				// Only process digest-specific metrics once
-				if _, ok := digests[img.Digest]; ok {
+				// Only process digest-specific metrics once for
+				// each platform
+				key := img.Digest + "|" + img.Platform
+				if _, ok := digests[key]; ok {
 					continue
 				}
-				digests[img.Digest] = struct{}{}
+				digests[key] = struct{}{}
 
-				ch <- prometheus.MustNewConstMetric(
-					metricSize, prometheus.GaugeValue, float64(img.Size), img.Digest,
-				)
-				ch <- prometheus.MustNewConstMetric(
-					metricCreated, prometheus.GaugeValue, float64(img.Created.Unix()), img.Digest,
-				)
+				collectImage(ch, img)
 
-				for k, v := range img.Annotations {
-					ch <- prometheus.MustNewConstMetric(
-						metricAnnotation,
-						prometheus.GaugeValue,
-						1.0,
-						img.Digest,
-						k,
-						v,
-					)
-				}
-				for k, v := range img.Labels {
-					ch <- prometheus.MustNewConstMetric(
-						metricLabel,
-						prometheus.GaugeValue,
-						1.0,
-						img.Digest,
-						k,
-						v,
-					)
+				if img.IndexMediaType != "" {
+					e.collectIndex(ctx, ch, container.Image, img, digests)
 				}
-
 			}
 		}
 	}
 }
 
-func (e *Exporter) fetchImage(ctx context.Context, imgRef string) (*ContainerImage, error) {
+// containerInfo returns the info metric for a container. With the
+// kube-state-metrics labels, Pods have a pod label so that they can be joined
+// to kube-state-metrics and cAdvisor series.
+func (e *Exporter) containerInfo(obj snapshotObject, ownerKind, ownerName string, container snapshotContainer, digestStr, runningDigestStr, platformStr string) prometheus.Metric {
+	labels := []string{
+		obj.gvk.Group,
+		obj.gvk.Version,
+		obj.gvk.Kind,
+		obj.Namespace,
+		obj.Name,
+	}
+	desc := metricContainerInfo
+	if e.ksmLabels {
+		desc = metricContainerInfoKSM
+		var pod string
+		if isPod(obj.gvk) {
+			pod = obj.Name
+		}
+		labels = append(labels, pod)
+	}
+	labels = append(labels,
+		ownerKind,
+		ownerName,
+		obj.currentRevision,
+		container.JSONPath,
+		container.Name,
+		container.Type,
+		container.Source,
+		container.Image,
+		imageTag(container.Image),
+		digestStr,
+		runningDigestStr,
+		platformStr,
+	)
+
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1.0, labels...)
+}
+
+// collectIndex collects the metrics that describe an image index
+func (e *Exporter) collectIndex(ctx context.Context, ch chan<- prometheus.Metric, imgRef string, img *ContainerImage, digests map[string]struct{}) {
+	// The same index may have been resolved to more than one platform
+	indexKey := "index|" + img.Digest
+	if _, ok := digests[indexKey]; ok {
+		return
+	}
+	digests[indexKey] = struct{}{}
+
+	ch <- prometheus.MustNewConstMetric(
+		metricIndexInfo, prometheus.GaugeValue, 1.0, img.Digest, img.IndexMediaType,
+	)
+	for k, v := range img.IndexAnnotations {
+		ch <- prometheus.MustNewConstMetric(
+			metricIndexAnnotation,
+			prometheus.GaugeValue,
+			1.0,
+			img.Digest,
+			k,
+			v,
+		)
+	}
+
+	// Different images in an index can have the same platform
+	platforms := map[string]struct{}{}
+	for _, manifest := range img.Manifests {
+		platform := manifest.Platform.String()
+		if _, ok := platforms[platform]; ok {
+			continue
+		}
+		platforms[platform] = struct{}{}
+
+		ch <- prometheus.MustNewConstMetric(
+			metricPlatforms, prometheus.GaugeValue, 1.0, img.Digest, platform,
+		)
+	}
+
+	if e.allPlatforms {
+		e.collectManifests(ctx, ch, imgRef, img, digests)
+	}
+}
+
+// collectManifests collects the metrics for every platform in an index
+func (e *Exporter) collectManifests(ctx context.Context, ch chan<- prometheus.Metric, imgRef string, img *ContainerImage, digests map[string]struct{}) {
 	ref, err := name.ParseReference(imgRef)
 	if err != nil {
-		return nil, fmt.Errorf("parsing image: %w", err)
+		return
+	}
+
+	for _, manifest := range img.Manifests {
+		ch <- prometheus.MustNewConstMetric(
+			metricIndexManifest,
+			prometheus.GaugeValue,
+			1.0,
+			img.Digest,
+			manifest.Digest,
+			manifest.Platform.OS,
+			manifest.Platform.Architecture,
+			manifest.Platform.Variant,
+			manifest.Platform.OSVersion,
+		)
+
+		cimg, err := e.cache.Get(ctx, ref.Context().Digest(manifest.Digest), &manifest.Platform)
+		if err != nil {
+			continue
+		}
+		key := cimg.Digest + "|" + cimg.Platform
+		if _, ok := digests[key]; ok {
+			continue
+		}
+		digests[key] = struct{}{}
+
+		collectImage(ch, cimg.ContainerImage)
 	}
+}
+
+// collectImage collects the metrics that describe a specific image digest
+func collectImage(ch chan<- prometheus.Metric, img *ContainerImage) {
+	ch <- prometheus.MustNewConstMetric(
+		metricSize, prometheus.GaugeValue, float64(img.Size), img.Digest, img.Platform,
+	)
 
-	img, err := e.cache.Get(ctx, ref)
+	// Artifacts don't have an image config to take the created date from
+	if !img.Created.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			metricCreated, prometheus.GaugeValue, float64(img.Created.Unix()), img.Digest, img.Platform,
+		)
+	}
+
+	for k, v := range img.Annotations {
+		ch <- prometheus.MustNewConstMetric(
+			metricAnnotation,
+			prometheus.GaugeValue,
+			1.0,
+			img.Digest,
+			img.Platform,
+			k,
+			v,
+		)
+	}
+	for k, v := range img.Labels {
+		ch <- prometheus.MustNewConstMetric(
+			metricLabel,
+			prometheus.GaugeValue,
+			1.0,
+			img.Digest,
+			img.Platform,
+			k,
+			v,
+		)
+	}
+}
+
+// collectResolutionError collects the error for an image, if it failed to
+// resolve. Each image is only collected once.
+func (e *Exporter) collectResolutionError(ch chan<- prometheus.Metric, image string, errImages map[string]struct{}) {
+	if image == "" {
+		return
+	}
+	if _, ok := errImages[image]; ok {
+		return
+	}
+	errImages[image] = struct{}{}
+
+	// The image may have failed for different reasons with the credentials
+	// of different objects
+	for _, reason := range e.resolutionErrors.reasons(image) {
+		ch <- prometheus.MustNewConstMetric(
+			metricResolutionError,
+			prometheus.GaugeValue,
+			1.0,
+			image,
+			reason,
+		)
+	}
+}
+
+// imageTag returns the tag in an image reference. References that are pinned
+// to a digest can include a tag too, like repo:tag@sha256:..., in which case
+// the tag is informational.
+func imageTag(imgRef string) string {
+	ref, err := name.ParseReference(imgRef)
+	if err != nil {
+		return ""
+	}
+	if tag, ok := ref.(name.Tag); ok {
+		return tag.TagStr()
+	}
+
+	base, _, _ := strings.Cut(imgRef, "@")
+	if strings.LastIndex(base, ":") <= strings.LastIndex(base, "/") {
+		return ""
+	}
+	tag, err := name.NewTag(base)
+	if err != nil {
+		return ""
+	}
+
+	return tag.TagStr()
+}
+
+// isTag returns true if the image reference is a tag, which may be moved to a
+// different digest
+func isTag(imgRef string) bool {
+	ref, err := name.ParseReference(imgRef)
 	if err != nil {
-		return nil, fmt.Errorf("fetching image from the cache: %w", err)
+		return false
 	}
+	_, ok := ref.(name.Tag)
 
-	return img.ContainerImage, nil
+	return ok
 }
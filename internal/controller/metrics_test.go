@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestImageTag(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		image string
+		tag   string
+		isTag bool
+	}{
+		{image: "nginx", tag: "latest", isTag: true},
+		{image: "nginx:1.25", tag: "1.25", isTag: true},
+		{image: "registry.example.com/team/app:v1", tag: "v1", isTag: true},
+		{image: "localhost:5000/app", tag: "latest", isTag: true},
+		{image: "localhost:5000/app:v1", tag: "v1", isTag: true},
+		{image: "nginx@" + digest, tag: "", isTag: false},
+		{image: "nginx:1.25@" + digest, tag: "1.25", isTag: false},
+		{image: "localhost:5000/app@" + digest, tag: "", isTag: false},
+		{image: "localhost:5000/app:v1@" + digest, tag: "v1", isTag: false},
+		{image: "Not A Reference", tag: "", isTag: false},
+	}
+	for _, tt := range tests {
+		if got := imageTag(tt.image); got != tt.tag {
+			t.Errorf("imageTag(%q) = %q, want %q", tt.image, got, tt.tag)
+		}
+		if got := isTag(tt.image); got != tt.isTag {
+			t.Errorf("isTag(%q) = %t, want %t", tt.image, got, tt.isTag)
+		}
+	}
+}
+
+func TestCollectRunningDigestWithoutMetadata(t *testing.T) {
+	exporter := NewExporter(NewContainerImageCache(), WithResources(DefaultResources))
+	runningDigest := "sha256:" + strings.Repeat("a", 64)
+	exporter.snapshot.set(snapshotObject{
+		snapshotKey: snapshotKey{
+			gvk:            DefaultResources[0].GroupVersionKind(),
+			NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"},
+		},
+		containers: []snapshotContainer{{
+			ContainerSpec: ContainerSpec{
+				Name:         "app",
+				Image:        "registry.example.com/app:latest",
+				RunningImage: "registry.example.com/app@" + runningDigest,
+			},
+		}},
+	})
+
+	// The running digest is exported even though its metadata wasn't
+	// fetched
+	metrics := containerInfo(t, exporter)
+	if len(metrics) != 1 {
+		t.Fatalf("expected 1 container_image_container_info metric, got %d", len(metrics))
+	}
+	if got := metrics[0]["running_digest"]; got != runningDigest {
+		t.Errorf("running_digest = %q, want %q", got, runningDigest)
+	}
+}
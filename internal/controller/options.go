@@ -13,11 +13,38 @@ type options struct {
 	k8sKeychain   bool
 	cacheDuration time.Duration
 	platform      *v1.Platform
+	resources     []Resource
+	discovery     bool
+	allPlatforms  bool
+	cache         ContainerImageCache
+	gracePeriod   time.Duration
+
+	defaultRegistryLimit RegistryLimit
+	registryLimits       []RegistryLimit
+
+	digestCacheDuration time.Duration
+	tagCacheDurations   []TagCacheDuration
+
+	ksmLabels        bool
+	excludeOwnedPods bool
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		cacheDuration: 1 * time.Hour,
+		gracePeriod:   24 * time.Hour,
+		resources:     DefaultResources,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
 }
 
 // WithCacheDuration is a functional option that configures the amount of time
-// the controller will cache image details before making another request to the
-// registry
+// the controller will cache the digest that a tag resolves to before checking
+// the registry again
 func WithCacheDuration(d time.Duration) Option {
 	return func(o *options) {
 		if d <= 0 {
@@ -42,3 +69,95 @@ func WithPlatform(platform *v1.Platform) Option {
 		o.platform = platform
 	}
 }
+
+// WithResources is a functional option that configures the kinds of objects
+// that the controller will look for containers in. If no resources are
+// provided then DefaultResources are used.
+func WithResources(resources []Resource) Option {
+	return func(o *options) {
+		if len(resources) == 0 {
+			return
+		}
+		o.resources = resources
+	}
+}
+
+// WithDiscovery is a functional option that configures whether the controller
+// will discover custom resources that embed pod specs and start watching them
+func WithDiscovery(discovery bool) Option {
+	return func(o *options) {
+		o.discovery = discovery
+	}
+}
+
+// WithAllPlatforms is a functional option that configures whether the
+// controller will fetch and export every platform in a multi-architecture
+// image, rather than just the platform it resolves to
+func WithAllPlatforms(allPlatforms bool) Option {
+	return func(o *options) {
+		o.allPlatforms = allPlatforms
+	}
+}
+
+// WithCache is a functional option that configures the cache that the
+// controller will store image details in. If no cache is provided then an
+// in-memory cache is used.
+func WithCache(cache ContainerImageCache) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// WithCacheGracePeriod is a functional option that configures how long an image
+// can go unreferenced by any object before it's removed from the cache. A
+// grace period of 0 disables garbage collection of the cache.
+func WithCacheGracePeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.gracePeriod = d
+	}
+}
+
+// WithRegistryLimits is a functional option that configures the rate and
+// concurrency limits for requests to registries. The default applies to every
+// registry, and the limits for specific hosts override it.
+func WithRegistryLimits(defaultLimit RegistryLimit, limits []RegistryLimit) Option {
+	return func(o *options) {
+		o.defaultRegistryLimit = defaultLimit
+		o.registryLimits = limits
+	}
+}
+
+// WithDigestCacheDuration is a functional option that configures the amount of
+// time the controller will cache the details of a digest before fetching them
+// again. If it's 0, the details never expire.
+func WithDigestCacheDuration(d time.Duration) Option {
+	return func(o *options) {
+		o.digestCacheDuration = d
+	}
+}
+
+// WithTagCacheDurations is a functional option that overrides the cache
+// duration for the tags in specific registries or that match a pattern
+func WithTagCacheDurations(durations []TagCacheDuration) Option {
+	return func(o *options) {
+		o.tagCacheDurations = durations
+	}
+}
+
+// WithKubeStateMetricsLabels is a functional option that configures whether
+// the exporter adds a pod label to the container metrics for Pods, so that
+// they can be joined to kube-state-metrics and cAdvisor series
+func WithKubeStateMetricsLabels(ksmLabels bool) Option {
+	return func(o *options) {
+		o.ksmLabels = ksmLabels
+	}
+}
+
+// WithExcludeOwnedPods is a functional option that configures whether Pods
+// are left out of the metrics when the object that controls them, like a
+// Deployment, is also watched
+func WithExcludeOwnedPods(excludeOwnedPods bool) Option {
+	return func(o *options) {
+		o.excludeOwnedPods = excludeOwnedPods
+	}
+}
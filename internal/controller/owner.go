@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// intermediateOwners are the kinds that are themselves created by another
+// object, like the ReplicaSets created by a Deployment. The owner references
+// of these kinds are followed to find the top-level owner of an object. Any
+// other kind is treated as the top of the chain, so that we don't need
+// permission to read arbitrary kinds.
+var intermediateOwners = map[schema.GroupKind]struct{}{
+	replicaSetGroupKind:           {},
+	{Group: "batch", Kind: "Job"}: {},
+}
+
+// maxOwnerDepth is the number of owner references that are followed before
+// giving up, in case the references form a loop
+const maxOwnerDepth = 5
+
+// objectOwner is the top-level object that controls an object, like the
+// Deployment that controls a Pod through a ReplicaSet
+type objectOwner struct {
+	schema.GroupKind
+	Name string
+}
+
+// labels returns the kind and name of the owner as label values, which are
+// empty if there isn't an owner
+func (o *objectOwner) labels() (string, string) {
+	if o == nil {
+		return "", ""
+	}
+
+	return o.Kind, o.Name
+}
+
+// isPod returns true if the kind is a core Pod
+func isPod(gvk schema.GroupVersionKind) bool {
+	return gvk.Group == "" && gvk.Kind == "Pod"
+}
+
+// topLevelOwner follows the controller references of the object to the object
+// at the top of the chain. It returns nil if the object isn't controlled by
+// anything, or if the chain can't be followed. The owner only adds labels to
+// the metrics of the object, so errors are logged rather than returned.
+func topLevelOwner(ctx context.Context, c client.Reader, obj metav1.Object) *objectOwner {
+	logger := ctrl.Log.WithValues("namespace", obj.GetNamespace(), "name", obj.GetName())
+
+	var owner *objectOwner
+	for range maxOwnerDepth {
+		ref := metav1.GetControllerOf(obj)
+		if ref == nil {
+			break
+		}
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			logger.Error(err, "Failed to parse api version of owner", "owner", ref.Name)
+			return nil
+		}
+		owner = &objectOwner{
+			GroupKind: schema.GroupKind{Group: gv.Group, Kind: ref.Kind},
+			Name:      ref.Name,
+		}
+		if _, ok := intermediateOwners[owner.GroupKind]; !ok {
+			break
+		}
+
+		// Only the metadata is needed, which is cheaper to cache than
+		// the full object
+		meta := &metav1.PartialObjectMetadata{}
+		meta.SetGroupVersionKind(gv.WithKind(ref.Kind))
+		if err := c.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: ref.Name}, meta); err != nil {
+			// The owner may have been deleted while its dependents
+			// are being garbage collected
+			if client.IgnoreNotFound(err) != nil {
+				logger.Error(err, "Failed to get owner", "kind", ref.Kind, "owner", ref.Name)
+				return nil
+			}
+			break
+		}
+		obj = meta
+	}
+
+	return owner
+}
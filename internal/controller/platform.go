@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// resolvePlatform returns the platform that the images in the object should
+// be resolved to. For pods that have been scheduled, this is the platform of
+// the node. Otherwise, the os and architecture can be pinned with a node
+// selector or required node affinity. Anything that isn't pinned is taken from
+// the default platform.
+func resolvePlatform(ctx context.Context, c client.Reader, resource Resource, obj *unstructured.Unstructured, defaultPlatform *v1.Platform) (*v1.Platform, error) {
+	for _, podSpecPath := range splitPaths(resource.PodSpecPaths) {
+		var os, arch string
+
+		nodeName, _, _ := unstructured.NestedString(obj.Object, appendPath(podSpecPath, "nodeName")...)
+		if nodeName != "" {
+			node := &corev1.Node{}
+			if err := c.Get(ctx, client.ObjectKey{Name: nodeName}, node); err != nil {
+				if client.IgnoreNotFound(err) != nil {
+					return nil, fmt.Errorf("getting node %s: %w", nodeName, err)
+				}
+			}
+			os = node.Labels[corev1.LabelOSStable]
+			arch = node.Labels[corev1.LabelArchStable]
+		}
+
+		if os == "" {
+			os = pinnedNodeLabel(obj, podSpecPath, corev1.LabelOSStable)
+		}
+		if arch == "" {
+			arch = pinnedNodeLabel(obj, podSpecPath, corev1.LabelArchStable)
+		}
+		if os == "" && arch == "" {
+			continue
+		}
+
+		p := &v1.Platform{
+			OS:           os,
+			Architecture: arch,
+		}
+		if defaultPlatform != nil {
+			if p.OS == "" {
+				p.OS = defaultPlatform.OS
+			}
+			if p.Architecture == "" {
+				p.Architecture = defaultPlatform.Architecture
+			}
+			if p.Architecture == defaultPlatform.Architecture {
+				p.Variant = defaultPlatform.Variant
+			}
+		}
+		if p.OS == "" {
+			p.OS = "linux"
+		}
+
+		return p, nil
+	}
+
+	return defaultPlatform, nil
+}
+
+// pinnedNodeLabel returns the value of the node label if the pod spec at the
+// path can only be scheduled to nodes with that value, either because of the
+// node selector or because every required node affinity term selects the same
+// single value
+func pinnedNodeLabel(obj *unstructured.Unstructured, podSpecPath []string, key string) string {
+	nodeSelector, _, _ := unstructured.NestedStringMap(obj.Object, appendPath(podSpecPath, "nodeSelector")...)
+	if v := nodeSelector[key]; v != "" {
+		return v
+	}
+
+	terms, _, _ := unstructured.NestedSlice(obj.Object, appendPath(podSpecPath, "affinity", "nodeAffinity", "requiredDuringSchedulingIgnoredDuringExecution", "nodeSelectorTerms")...)
+	var pinned string
+	for _, term := range terms {
+		data, ok := term.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v := pinnedNodeSelectorTerm(data, key)
+		if v == "" || (pinned != "" && v != pinned) {
+			return ""
+		}
+		pinned = v
+	}
+
+	return pinned
+}
+
+// pinnedNodeSelectorTerm returns the value of the node label if the term only
+// matches nodes with that value
+func pinnedNodeSelectorTerm(term map[string]interface{}, key string) string {
+	expressions, _, _ := unstructured.NestedSlice(term, "matchExpressions")
+	for _, expression := range expressions {
+		data, ok := expression.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if data["key"] != key || data["operator"] != string(corev1.NodeSelectorOpIn) {
+			continue
+		}
+		values, _, _ := unstructured.NestedStringSlice(data, "values")
+		if len(values) == 1 {
+			return values[0]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// defaultRetryAfter is how long requests to a registry are paused for when it
+// responds with 429 Too Many Requests but doesn't say when to retry
+const defaultRetryAfter = 1 * time.Minute
+
+// pausedRegistries are the registries that have asked us to stop making
+// requests. They're shared by every reconciler.
+var pausedRegistries = &registryPauses{
+	until: map[string]time.Time{},
+}
+
+// registryPauses records when requests to each registry can resume
+type registryPauses struct {
+	until map[string]time.Time
+	lock  sync.RWMutex
+}
+
+// pause stops requests to the registry until the given time, unless it's
+// already paused for longer
+func (p *registryPauses) pause(registry string, until time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if until.After(p.until[registry]) {
+		p.until[registry] = until
+	}
+}
+
+// pausedUntil returns the time that requests to the registry can resume, if
+// it's paused
+func (p *registryPauses) pausedUntil(registry string) (time.Time, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	until, ok := p.until[registry]
+	if !ok || time.Now().After(until) {
+		return time.Time{}, false
+	}
+
+	return until, true
+}
+
+// imagePausedUntil returns the time that requests for the image can resume,
+// if its registry is paused
+func imagePausedUntil(image string) (time.Time, bool) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return pausedRegistries.pausedUntil(ref.Context().RegistryStr())
+}
+
+// registryPausedError is returned when a request isn't made to a registry
+// because it's paused
+type registryPausedError struct {
+	registry string
+	until    time.Time
+}
+
+func (e *registryPausedError) Error() string {
+	return fmt.Sprintf("requests to %s are paused until %s", e.registry, e.until.Format(time.RFC3339))
+}
+
+// observeRateLimit records the rate limit reported by the registry and pauses
+// requests to it if it asks us to back off. The response may come from a
+// token service or a host that serves blobs, so the limit is attributed to
+// the registry of the image the request was made for.
+func observeRateLimit(req *http.Request, resp *http.Response) {
+	host := registryFromContext(req.Context(), req.URL.Host)
+	credential := credentialFromContext(req.Context()).get()
+
+	if limit, ok := parseRateLimit(resp.Header.Get("ratelimit-limit")); ok {
+		registryRateLimit.WithLabelValues(host, credential).Set(limit)
+	}
+	if remaining, ok := parseRateLimit(resp.Header.Get("ratelimit-remaining")); ok {
+		registryRateLimitRemaining.WithLabelValues(host, credential).Set(remaining)
+	}
+
+	d, ok := retryAfter(resp.Header.Get("Retry-After"))
+	if !ok && resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	if !ok {
+		d = defaultRetryAfter
+	}
+	pausedRegistries.pause(host, time.Now().Add(d))
+}
+
+// parseRateLimit parses the value of a rate limit header, like 100;w=21600,
+// where the first number is the number of requests and the rest describes
+// the window
+func parseRateLimit(v string) (float64, bool) {
+	if v == "" {
+		return 0, false
+	}
+	n, _, _ := strings.Cut(v, ";")
+	f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return f, true
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or a date
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+
+	return 0, false
+}
+
+type registryKey struct{}
+
+// withRegistry returns a context that records the registry of the image that
+// requests made with it are for
+func withRegistry(ctx context.Context, registry string) context.Context {
+	return context.WithValue(ctx, registryKey{}, registry)
+}
+
+// registryFromContext returns the registry recorded in the context, or the
+// fallback if there isn't one
+func registryFromContext(ctx context.Context, fallback string) string {
+	if registry, ok := ctx.Value(registryKey{}).(string); ok && registry != "" {
+		return registry
+	}
+
+	return fallback
+}
+
+type credentialKey struct{}
+
+// requestCredential is the username of the credential used for the requests
+// made for an image, so that rate limits can be attributed to it
+type requestCredential struct {
+	username string
+	lock     sync.Mutex
+}
+
+// withCredential returns a context that records the credential that requests
+// made with it are authenticated with
+func withCredential(ctx context.Context) context.Context {
+	return context.WithValue(ctx, credentialKey{}, &requestCredential{})
+}
+
+func credentialFromContext(ctx context.Context) *requestCredential {
+	c, _ := ctx.Value(credentialKey{}).(*requestCredential)
+
+	return c
+}
+
+// observe records the username if the request uses basic authentication.
+// Registries that use token authentication only see the username when the
+// token is requested.
+func (c *requestCredential) observe(req *http.Request) {
+	if c == nil {
+		return
+	}
+	username, _, ok := req.BasicAuth()
+	if !ok || username == "" {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.username = username
+}
+
+// get returns the username, or anonymous if the requests haven't been
+// authenticated with a username
+func (c *requestCredential) get() string {
+	if c == nil {
+		return "anonymous"
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.username == "" {
+		return "anonymous"
+	}
+
+	return c.username
+}
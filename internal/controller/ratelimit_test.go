@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserveRateLimitPausesImageRegistry(t *testing.T) {
+	// The token service for a registry is often on a different host, like
+	// auth.docker.io for index.docker.io
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	registry := "ratelimit.registry.example.com"
+	host := strings.TrimPrefix(srv.URL, "http://")
+	t.Cleanup(func() {
+		pausedRegistries.lock.Lock()
+		defer pausedRegistries.lock.Unlock()
+		delete(pausedRegistries.until, registry)
+		delete(pausedRegistries.until, host)
+	})
+
+	ctx := withRegistry(withCredential(context.Background()), registry)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/token?scope=repository:app:pull", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &instrumentedTransport{next: http.DefaultTransport}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	until, ok := pausedRegistries.pausedUntil(registry)
+	if !ok {
+		t.Fatalf("expected %s to be paused", registry)
+	}
+	if d := time.Until(until); d < 50*time.Second || d > 60*time.Second {
+		t.Errorf("expected %s to be paused for 60s, got %s", registry, d)
+	}
+	if _, ok := pausedRegistries.pausedUntil(host); ok {
+		t.Errorf("expected the token service %s not to be paused", host)
+	}
+
+	// Further requests for the registry aren't made while it's paused
+	if _, err := transport.RoundTrip(req); !errors.As(err, new(*registryPausedError)) {
+		t.Errorf("expected a registryPausedError, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request to be made, got %d", requests)
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "100", want: 100, ok: true},
+		{value: "100;w=21600", want: 100, ok: true},
+		{value: " 76 ;w=21600", want: 76, ok: true},
+		{value: "0;w=60", want: 0, ok: true},
+		{value: "lots", ok: false},
+		{value: ";w=21600", ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRateLimit(tt.value)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseRateLimit(%q) = %v, %t, want %v, %t", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "0", want: 0, ok: true},
+		{value: "120", want: 2 * time.Minute, ok: true},
+		{value: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), want: time.Hour, ok: true},
+		{value: "soon", ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.value)
+		if ok != tt.ok {
+			t.Errorf("retryAfter(%q) ok = %t, want %t", tt.value, ok, tt.ok)
+			continue
+		}
+		// Dates only have a precision of a second
+		if diff := got - tt.want; diff < -time.Second || diff > time.Second {
+			t.Errorf("retryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"slices"
 	"strings"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -25,44 +27,103 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/google"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/singleflight"
 )
 
 // ContainerImage describes a container image
 type ContainerImage struct {
 	// Digest is the digest of the image
-	Digest string
+	Digest string `json:"digest"`
 
 	// Annotations are the annotations on the image manifest
-	Annotations map[string]string
+	Annotations map[string]string `json:"annotations,omitempty"`
 
 	// Labels are the labels in the image config
-	Labels map[string]string
+	Labels map[string]string `json:"labels,omitempty"`
 
 	// Size is the size of the image in the registry
-	Size int64
+	Size int64 `json:"size"`
 
 	// Created is created time from the image config
-	Created time.Time
+	Created time.Time `json:"created"`
+
+	// Platform is the platform of the image, from the image config
+	Platform string `json:"platform,omitempty"`
+
+	// IndexMediaType is the media type of the index when the reference
+	// resolved to an index
+	IndexMediaType string `json:"indexMediaType,omitempty"`
+
+	// IndexAnnotations are the annotations on the index manifest
+	IndexAnnotations map[string]string `json:"indexAnnotations,omitempty"`
+
+	// Manifests are the images for each platform when the reference
+	// resolved to an index
+	Manifests []PlatformManifest `json:"manifests,omitempty"`
+
+	// Fetched is when the details were fetched from the registry
+	Fetched time.Time `json:"fetched"`
+}
+
+// hasManifest returns true if the digest is one of the platform images in the
+// index
+func (c *ContainerImage) hasManifest(digest string) bool {
+	for _, manifest := range c.Manifests {
+		if manifest.Digest == digest {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PlatformManifest is an image for a specific platform in an index
+type PlatformManifest struct {
+	// Digest is the digest of the image manifest
+	Digest string `json:"digest"`
+
+	// Platform is the platform of the image
+	Platform v1.Platform `json:"platform"`
 }
 
 // ContainerImageReconciler reconciles container images described in a
 // Kubernetes object
 type ContainerImageReconciler struct {
 	client.Client
-	KubeClient       kubernetes.Interface
-	GroupVersionKind schema.GroupVersionKind
-	Cache            ContainerImageCache
-	CacheDuration    time.Duration
-	Platform         *v1.Platform
-	K8sKeychain      bool
+	KubeClient    kubernetes.Interface
+	Resource      Resource
+	Cache         ContainerImageCache
+	CacheDuration time.Duration
+	Platform      *v1.Platform
+	K8sKeychain   bool
+	AllPlatforms  bool
+
+	// DigestCacheDuration is how long the details of a digest are cached
+	// for. If it's 0, they never expire.
+	DigestCacheDuration time.Duration
+
+	// tagCacheDurations overrides the cache duration for specific tags
+	tagCacheDurations *tagCacheDurations
+
+	// resolutionErrors records the images that failed to resolve
+	resolutionErrors *resolutionErrors
+
+	// registryLimiters limits the requests made to each registry
+	registryLimiters *registryLimiters
+
+	// fetches coalesces concurrent fetches of the same image
+	fetches *singleflight.Group
+
+	// snapshot is the index of objects that metrics are exported from
+	snapshot *snapshot
 }
 
 // Reconcile reconciles objects that define containers
 func (r *ContainerImageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := ctrl.Log.WithValues(
-		"group", r.GroupVersionKind.Group,
-		"version", r.GroupVersionKind.Version,
-		"kind", r.GroupVersionKind.Kind,
+		"group", r.Resource.Group,
+		"version", r.Resource.Version,
+		"kind", r.Resource.Kind,
 		"namespace", req.Namespace,
 		"name", req.Name,
 	)
@@ -70,50 +131,233 @@ func (r *ContainerImageReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 
 	// Get the object
 	obj := &unstructured.Unstructured{}
-	obj.SetGroupVersionKind(r.GroupVersionKind)
+	obj.SetGroupVersionKind(r.Resource.GroupVersionKind())
 	if err := r.Client.Get(ctx, req.NamespacedName, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.snapshot.delete(r.Resource.GroupVersionKind(), req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// Pods are attributed to the workload that created them, like the
+	// Deployment that owns their ReplicaSet
+	owner := topLevelOwner(ctx, r.Client, obj)
+
+	// ReplicaSets are marked with whether they're the current revision of
+	// their Deployment. Old revisions are kept as rollout history after
+	// they've been scaled down, but they aren't running anything.
+	revision := currentRevision(ctx, r.Client, obj)
+	if revision == "false" && !hasReplicas(obj) {
+		logger.Info("Skipping old revision with no replicas")
+		r.snapshot.delete(r.Resource.GroupVersionKind(), req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+
+	// The object is written to the snapshot whether or not its images
+	// resolve, so that every object is exported. Images that can't be
+	// resolved are left nil.
+	containers := r.Resource.containerSpecs(obj)
+	snapshotContainers := make([]snapshotContainer, len(containers))
+	for i, container := range containers {
+		snapshotContainers[i].ContainerSpec = container
+	}
+	setSnapshot := func() {
+		r.snapshot.set(snapshotObject{
+			snapshotKey: snapshotKey{
+				gvk:            r.Resource.GroupVersionKind(),
+				NamespacedName: req.NamespacedName,
+			},
+			owner:           owner,
+			currentRevision: revision,
+			replicas:        r.Resource.replicas(obj),
+			containers:      snapshotContainers,
+		})
+	}
+
+	// Multi-architecture images are resolved to the platform of the node
+	// that the object is scheduled to, or is pinned to
+	platform, err := resolvePlatform(ctx, r.Client, r.Resource, obj, r.Platform)
+	if err != nil {
+		logger.Error(err, "Failed to resolve platform, using the default", "platform", r.Platform)
+		platform = r.Platform
+	}
+
 	// Construct a keychain for retrieving credentials
 	kc, err := r.newKeychain(ctx, obj)
 	if err != nil {
+		setSnapshot()
 		return ctrl.Result{}, fmt.Errorf("constructing keychain: %w", err)
 	}
 
-	// Construct a keychain which uses the pull secrets attached to the object
-	// and/or the object's service account, as well any cloud provider
-	// credentials or docker config.
-	opts := k8schain.Options{
-		Namespace:          obj.GetNamespace(),
-		ServiceAccountName: serviceAccountName(obj),
-		ImagePullSecrets:   imagePullSecrets(obj),
-	}
-	kc, err := k8schain.New(ctx, r.KubeClient, opts)
-	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("constructing k8s keychain: %w", err)
+	// Errors are recorded for the credentials the image was fetched with,
+	// so that objects with different pull secrets don't overwrite each
+	// other's errors for the same image
+	keychain := r.keychainID(obj)
+
+	// Requests to the registry are authenticated with the keychain and
+	// instrumented by the transport
+	opts := []remote.Option{
+		remote.WithAuthFromKeychain(kc),
+		remote.WithTransport(registryTransport),
 	}
 
 	// Iterate over every container spec in the object, fetching the image
-	// metadata. This populates the cache that we export metrics from.
-	for _, container := range containerSpecs(obj) {
-		logger.Info("Fetching image metadata", "image", container.Image)
-		img, err := r.getImage(ctx, container.Image, remote.WithAuthFromKeychain(kc))
+	// metadata. This populates the cache and the snapshot that we export
+	// metrics from. Each image is resolved independently, so that one
+	// broken image doesn't stop metrics being exported for the others.
+	var transientErrs []error
+	requeueAfter := r.requeueAfter(containers)
+	handleErr := func(image string, err error) {
+		// Registries that are rate limiting us are retried once the
+		// limit resets, without counting as a failure
+		if until, ok := imagePausedUntil(image); ok {
+			logger.Info("Registry is rate limited", "image", image, "until", until)
+			requeueAfter = sooner(requeueAfter, max(time.Until(until), time.Second))
+			return
+		}
+
+		rerr := r.resolutionErrors.set(image, keychain, err)
+		logger.Error(err, "Failed to fetch image metadata", "image", image, "reason", rerr.Reason)
+
+		// Errors like a missing image or bad credentials won't be fixed
+		// by retrying straight away, so back off before trying again
+		if isPermanentReason(rerr.Reason) {
+			requeueAfter = sooner(requeueAfter, rerr.backoff())
+			return
+		}
+		transientErrs = append(transientErrs, fmt.Errorf("fetching image details for %s: %w", image, err))
+	}
+	for i, container := range containers {
+		sc := &snapshotContainers[i]
+
+		logger.Info("Fetching image metadata", "image", container.Image, "platform", platform)
+		img, err := r.getImage(ctx, container.Image, platform, opts...)
 		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("fetching image details: %w", err)
+			handleErr(container.Image, err)
+
+			// Keep exporting what the image resolved to before,
+			// if it's still in the cache
+			sc.image = r.cachedImage(ctx, container.Image, platform)
+			sc.runningImage = r.cachedImage(ctx, container.RunningImage, platform)
+			continue
 		}
+		r.resolutionErrors.clear(container.Image, keychain)
+		sc.image = img
 		logger.Info("Fetched image metadata", "image", container.Image, "digest", img.Digest)
+
+		// Fetch the metadata for the image the container is actually
+		// running, if it's different to the one the reference resolves
+		// to now
+		if container.RunningImage == "" {
+			continue
+		}
+		if strings.HasSuffix(container.RunningImage, "@"+img.Digest) {
+			sc.runningImage = img
+			continue
+		}
+		// The running digest is already known from the container
+		// status, so failing to fetch its metadata isn't an error. Old
+		// builds are often deleted from the registry while they're
+		// still running.
+		logger.Info("Fetching running image metadata", "image", container.RunningImage)
+		runningImg, err := r.getImage(ctx, container.RunningImage, platform, opts...)
+		if err != nil {
+			logger.Info("Failed to fetch running image metadata", "image", container.RunningImage, "error", err.Error())
+			sc.runningImage = r.cachedImage(ctx, container.RunningImage, platform)
+			continue
+		}
+		sc.runningImage = runningImg
+	}
+	setSnapshot()
+
+	// Transient errors are returned so that the object is retried quickly
+	// with the controller's rate limiter
+	if len(transientErrs) > 0 {
+		return ctrl.Result{}, errors.Join(transientErrs...)
 	}
 
 	// Tags are mutable so we should periodically check to see if the digest
 	// of any of the container images has changed by requeueing the object.
-	d := addJitter(r.CacheDuration)
+	// Objects that only use digests aren't requeued.
+	d := addJitter(requeueAfter)
 	logger.Info("Reconciled", "requeue_after", d)
 	return ctrl.Result{
 		RequeueAfter: d,
 	}, nil
 }
 
+// cachedImage returns the cached details of an image, even if they're stale,
+// or nil if there aren't any
+func (r *ContainerImageReconciler) cachedImage(ctx context.Context, imgRef string, platform *v1.Platform) *ContainerImage {
+	if r.Cache == nil || imgRef == "" {
+		return nil
+	}
+	ref, err := name.ParseReference(imgRef)
+	if err != nil {
+		return nil
+	}
+	cimg, err := r.Cache.Get(ctx, ref, platform)
+	if err != nil {
+		return nil
+	}
+
+	return cimg.ContainerImage
+}
+
+// requeueAfter returns how long to wait before checking whether the tags used
+// by the containers have moved. References that are pinned to a digest can't
+// move, so if every container is pinned the object is only requeued when the
+// details of the digests expire, if they do.
+func (r *ContainerImageReconciler) requeueAfter(containers []ContainerSpec) time.Duration {
+	var d time.Duration
+	for _, container := range containers {
+		ref, err := name.ParseReference(container.Image)
+		if err != nil {
+			continue
+		}
+		if _, ok := ref.(name.Digest); ok {
+			continue
+		}
+		if td := r.tagCacheDuration(ref); d == 0 || td < d {
+			d = td
+		}
+	}
+	if d == 0 {
+		return r.DigestCacheDuration
+	}
+	if r.DigestCacheDuration > 0 {
+		d = min(d, r.DigestCacheDuration)
+	}
+
+	return d
+}
+
+// sooner returns the shorter of two requeue durations, where 0 means the
+// object isn't requeued
+func sooner(a, b time.Duration) time.Duration {
+	if a == 0 {
+		return b
+	}
+
+	return min(a, b)
+}
+
+// tagCacheDuration returns how long the digest that a tag resolves to is
+// cached for
+func (r *ContainerImageReconciler) tagCacheDuration(ref name.Reference) time.Duration {
+	if r.tagCacheDurations == nil {
+		return r.CacheDuration
+	}
+
+	return r.tagCacheDurations.duration(ref)
+}
+
+// isFresh returns true if the details of the image don't need to be fetched
+// again
+func (r *ContainerImageReconciler) isFresh(img *ContainerImage) bool {
+	return r.DigestCacheDuration <= 0 || time.Now().Before(img.Fetched.Add(r.DigestCacheDuration))
+}
+
 // addJitter adds random jitter to a duration, extending it by up to 1/6 of the
 // original duration. This helps spread out reconciliation times to avoid
 // thundering herd problems.
@@ -121,28 +365,94 @@ func addJitter(d time.Duration) time.Duration {
 	if d <= 0 {
 		return d
 	}
-	// Add jitter between 0 and d/6
+	// Add jitter between 0 and d/6. Durations that are too short to have
+	// any jitter are returned as they are.
 	maxJitter := d / 6
+	if maxJitter <= 0 {
+		return d
+	}
 	jitter := time.Duration(rand.Int63n(int64(maxJitter)))
 	return d + jitter
 }
 
-func (r *ContainerImageReconciler) getImage(ctx context.Context, imgRef string, opts ...remote.Option) (*ContainerImage, error) {
+func (r *ContainerImageReconciler) getImage(ctx context.Context, imgRef string, platform *v1.Platform, opts ...remote.Option) (*ContainerImage, error) {
 	ref, err := name.ParseReference(imgRef)
 	if err != nil {
 		return nil, fmt.Errorf("parsing image reference: %w", err)
 	}
 
 	// If the cache is configured, attempt to get the details from that
-	// first
+	// first. The details of a digest don't change, so they're fresh until
+	// the digest cache duration passes, if there is one. Tags have to be
+	// resolved again once their own cache duration has passed.
+	var cached *CachedContainerImage
 	if r.Cache != nil {
-		cimg, err := r.Cache.Get(ctx, ref)
-		if err == nil && time.Now().Before(cimg.Time.Add(r.CacheDuration)) {
-			return cimg.ContainerImage, nil
-		}
-		if !errors.Is(err, ErrContainerImageNotFound) {
+		cimg, err := r.Cache.Get(ctx, ref, platform)
+		if err != nil && !errors.Is(err, ErrContainerImageNotFound) {
 			return nil, fmt.Errorf("fetching image details from cache: %w", err)
 		}
+		if err == nil && r.isFresh(cimg.ContainerImage) {
+			if _, ok := ref.(name.Digest); ok || time.Now().Before(cimg.Time.Add(r.tagCacheDuration(ref))) {
+				return cimg.ContainerImage, nil
+			}
+			cached = cimg
+		}
+	}
+
+	// Objects that use the same reference often miss the cache at the same
+	// time, like during a rollout, so concurrent fetches are coalesced into
+	// a single request to the registry
+	if r.fetches == nil {
+		return r.fetchImage(ctx, ref, platform, cached, opts...)
+	}
+	v, err, shared := r.fetches.Do(imageKey(ref.String(), platform), func() (interface{}, error) {
+		return r.fetchImage(ctx, ref, platform, cached, opts...)
+	})
+
+	// Whether an image can be fetched may depend on the credentials of the
+	// object, so authentication errors aren't shared with other objects
+	if err != nil && shared && isAuthReason(errorReason(err)) {
+		return r.fetchImage(ctx, ref, platform, cached, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*ContainerImage), nil
+}
+
+// fetchImage fetches the details of an image from the registry and puts them
+// into the cache. If the details of the image that the reference resolved to
+// previously are cached, then they're reused if it still resolves to the same
+// digest.
+func (r *ContainerImageReconciler) fetchImage(ctx context.Context, ref name.Reference, platform *v1.Platform, cached *CachedContainerImage, opts ...remote.Option) (*ContainerImage, error) {
+	// Don't make any requests to a registry that is rate limiting us
+	if until, ok := pausedRegistries.pausedUntil(ref.Context().RegistryStr()); ok {
+		return nil, &registryPausedError{registry: ref.Context().RegistryStr(), until: until}
+	}
+
+	// Wait for our turn to make requests to the registry. The slot is held
+	// until the image and its config have been fetched too.
+	release, err := r.registryLimiters.acquire(ctx, ref.Context().RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The rate limits reported by the registry are recorded against its
+	// name and the credential that the requests are authenticated with
+	ctx = withRegistry(withCredential(ctx), ref.Context().RegistryStr())
+
+	// Checking the digest of the tag with a HEAD request is much cheaper
+	// than fetching the manifest and config again
+	if cached != nil {
+		cimg, err := r.revalidate(ctx, ref, platform, cached, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if cimg != nil {
+			return cimg, nil
+		}
 	}
 
 	desc, err := remote.Get(ref, append(opts, remote.WithContext(ctx))...)
@@ -150,19 +460,139 @@ func (r *ContainerImageReconciler) getImage(ctx context.Context, imgRef string,
 		return nil, fmt.Errorf("getting descriptor: %s: %w", ref, err)
 	}
 
-	img, err := getImage(desc, r.Platform)
+	img, idx, err := getImage(desc, platform)
 	if err != nil {
 		return nil, fmt.Errorf("getting image: %w", err)
 	}
 
-	manifest, err := img.Manifest()
+	cimg, err := newContainerImage(desc.Digest, img)
 	if err != nil {
-		return nil, fmt.Errorf("getting manifest: %w", err)
+		return nil, err
 	}
 
-	configFile, err := img.ConfigFile()
+	if idx != nil {
+		indexManifest, err := idx.IndexManifest()
+		if err != nil {
+			return nil, fmt.Errorf("getting index manifest: %w", err)
+		}
+		cimg.IndexMediaType = string(desc.MediaType)
+		cimg.IndexAnnotations = indexManifest.Annotations
+		for _, manifest := range indexManifest.Manifests {
+			if !isPlatformManifest(manifest) {
+				continue
+			}
+			cimg.Manifests = append(cimg.Manifests, PlatformManifest{
+				Digest:   manifest.Digest.String(),
+				Platform: *manifest.Platform,
+			})
+		}
+
+		// Fetch and cache every image in the index, so that metrics
+		// can be exported for each platform
+		if r.AllPlatforms {
+			r.cacheManifests(ctx, ref.Context(), cimg.Manifests, opts...)
+		}
+	}
+
+	// If a cache is configured then cache the details
+	if r.Cache != nil {
+		if err := r.Cache.Put(ctx, ref, platform, cimg); err != nil {
+			return nil, fmt.Errorf("putting details for %s into the cache: %w", desc.Digest, err)
+		}
+	}
+
+	return cimg, nil
+}
+
+// revalidate checks whether the reference still resolves to the digest of the
+// cached image. If it does, or if it now resolves to a digest that is already
+// cached, the cached details are returned. Otherwise nil is returned and the
+// image must be fetched.
+func (r *ContainerImageReconciler) revalidate(ctx context.Context, ref name.Reference, platform *v1.Platform, cached *CachedContainerImage, opts ...remote.Option) (*ContainerImage, error) {
+	desc, err := remote.Head(ref, append(opts, remote.WithContext(ctx))...)
 	if err != nil {
-		return nil, fmt.Errorf("getting config: %w", err)
+		// Some registries don't respond to HEAD requests properly, so
+		// fall back to fetching the manifest unless the registry told
+		// us why the image can't be fetched
+		if errorReason(err) != reasonUnknown {
+			return nil, fmt.Errorf("getting descriptor: %s: %w", ref, err)
+		}
+		return nil, nil
+	}
+
+	cimg := cached.ContainerImage
+	if desc.Digest.String() != cimg.Digest {
+		latest, err := r.Cache.Get(ctx, ref.Context().Digest(desc.Digest.String()), platform)
+		if err != nil || !r.isFresh(latest.ContainerImage) {
+			return nil, nil
+		}
+		cimg = latest.ContainerImage
+	}
+
+	if err := r.Cache.Put(ctx, ref, platform, cimg); err != nil {
+		return nil, fmt.Errorf("putting details for %s into the cache: %w", cimg.Digest, err)
+	}
+
+	// The images in the index may have been evicted from the cache since
+	// it was fetched, or never cached if they failed
+	if r.AllPlatforms {
+		r.cacheManifests(ctx, ref.Context(), cimg.Manifests, opts...)
+	}
+
+	return cimg, nil
+}
+
+// cacheManifests fetches the images in an index and puts them into the cache,
+// keyed by their own digest and platform. Images that are already cached are
+// skipped because the contents of a digest never changes. An image that can't
+// be fetched is counted as a failure and skipped, so that it doesn't stop the
+// index and the rest of its images from being exported.
+func (r *ContainerImageReconciler) cacheManifests(ctx context.Context, repo name.Repository, manifests []PlatformManifest, opts ...remote.Option) {
+	if r.Cache == nil {
+		return
+	}
+
+	for _, manifest := range manifests {
+		ref := repo.Digest(manifest.Digest)
+		if _, err := r.Cache.Get(ctx, ref, &manifest.Platform); err == nil {
+			continue
+		}
+
+		if err := r.cacheManifest(ctx, ref, &manifest.Platform, opts...); err != nil {
+			ctrl.Log.Error(err, "Failed to cache image in index", "image", ref.String(), "platform", manifest.Platform.String())
+			resolutionFailures.WithLabelValues(repo.RegistryStr()).Inc()
+		}
+	}
+}
+
+// cacheManifest fetches an image in an index and puts it into the cache
+func (r *ContainerImageReconciler) cacheManifest(ctx context.Context, ref name.Digest, platform *v1.Platform, opts ...remote.Option) error {
+	hash, err := v1.NewHash(ref.DigestStr())
+	if err != nil {
+		return fmt.Errorf("parsing digest: %w", err)
+	}
+	img, err := remote.Image(ref, append(opts, remote.WithContext(ctx))...)
+	if err != nil {
+		return fmt.Errorf("getting image: %w", err)
+	}
+	cimg, err := newContainerImage(hash, img)
+	if err != nil {
+		return err
+	}
+	if err := r.Cache.Put(ctx, ref, platform, cimg); err != nil {
+		return fmt.Errorf("putting details for %s into the cache: %w", ref.DigestStr(), err)
+	}
+
+	return nil
+}
+
+// newContainerImage reads the details of an image from its manifest and
+// config. The digest is the digest of the reference that was resolved to the
+// image, which may be an index.
+func newContainerImage(digest v1.Hash, img v1.Image) (*ContainerImage, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
 	}
 
 	sz := manifest.Config.Size
@@ -171,19 +601,25 @@ func (r *ContainerImageReconciler) getImage(ctx context.Context, imgRef string,
 	}
 
 	cimg := &ContainerImage{
-		Digest:      desc.Digest.String(),
-		Annotations: desc.Annotations,
-		Labels:      configFile.Config.Labels,
+		Digest:      digest.String(),
+		Annotations: manifest.Annotations,
 		Size:        sz,
-		Created:     configFile.Created.Time,
+		Fetched:     time.Now(),
 	}
 
-	// If a cache is configured then cache the details
-	if r.Cache != nil {
-		if err := r.Cache.Put(ctx, ref, cimg); err != nil {
-			return nil, fmt.Errorf("putting details for %s into the cache: %w", desc.Digest, err)
-		}
+	// Artifacts, like the ones mounted by image volumes, can have any kind
+	// of config, so the labels, created time and platform are only read from
+	// image configs
+	if !manifest.Config.MediaType.IsConfig() {
+		return cimg, nil
 	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting config: %w", err)
+	}
+	cimg.Labels = configFile.Config.Labels
+	cimg.Created = configFile.Created.Time
+	cimg.Platform = configPlatform(configFile).String()
 
 	return cimg, nil
 }
@@ -208,8 +644,8 @@ func (r *ContainerImageReconciler) newKeychain(ctx context.Context, obj *unstruc
 	if r.K8sKeychain {
 		opts := k8schain.Options{
 			Namespace:          obj.GetNamespace(),
-			ServiceAccountName: serviceAccountName(obj),
-			ImagePullSecrets:   imagePullSecrets(obj),
+			ServiceAccountName: r.Resource.serviceAccountName(obj),
+			ImagePullSecrets:   r.Resource.imagePullSecrets(obj),
 		}
 		k8s, err := kauth.New(ctx, r.KubeClient, kauth.Options(opts))
 		if err != nil {
@@ -221,39 +657,91 @@ func (r *ContainerImageReconciler) newKeychain(ctx context.Context, obj *unstruc
 	return authn.NewMultiKeychain(keychains...), nil
 }
 
-func getImage(desc *remote.Descriptor, platform *v1.Platform) (v1.Image, error) {
+// keychainID identifies the credentials that the images in the object are
+// fetched with. Objects in the same namespace that reference the same service
+// account and pull secrets share an identity.
+func (r *ContainerImageReconciler) keychainID(obj *unstructured.Unstructured) string {
+	if !r.K8sKeychain {
+		return ""
+	}
+	serviceAccountName := r.Resource.serviceAccountName(obj)
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	pullSecrets := slices.Sorted(slices.Values(r.Resource.imagePullSecrets(obj)))
+
+	return obj.GetNamespace() + "/" + serviceAccountName + "/" + strings.Join(pullSecrets, ",")
+}
+
+// getImage returns the image that the descriptor refers to. If the descriptor
+// is an index, the image for the platform is returned along with the index.
+func getImage(desc *remote.Descriptor, platform *v1.Platform) (v1.Image, v1.ImageIndex, error) {
 	switch desc.MediaType {
 	case types.OCIImageIndex, types.DockerManifestList:
 		idx, err := desc.ImageIndex()
 		if err != nil {
-			return nil, fmt.Errorf("fetching index: %w", err)
+			return nil, nil, fmt.Errorf("fetching index: %w", err)
 		}
 		indexManifest, err := idx.IndexManifest()
 		if err != nil {
-			return nil, fmt.Errorf("fetching manifest: %w", err)
+			return nil, nil, fmt.Errorf("fetching manifest: %w", err)
 		}
 		if len(indexManifest.Manifests) == 0 {
-			return nil, fmt.Errorf("no manifests in index: %w", err)
+			return nil, nil, fmt.Errorf("no manifests in index")
 		}
 
 		// If a platform is configured then look for it in the manifests
 		if platform != nil {
 			for _, manifest := range indexManifest.Manifests {
-				if manifest.Platform.Equals(*platform) {
-					return idx.Image(manifest.Digest)
+				if manifest.Platform != nil && manifest.Platform.Satisfies(*platform) {
+					img, err := idx.Image(manifest.Digest)
+					return img, idx, err
 				}
 			}
 		}
 
 		// If not, or if the platform doesn't exist in the manifests,
 		// just return the first one in the list.
-		return idx.Image(indexManifest.Manifests[0].Digest)
+		img, err := idx.Image(indexManifest.Manifests[0].Digest)
+		return img, idx, err
 	}
 
-	return desc.Image()
+	img, err := desc.Image()
+	return img, nil, err
+}
+
+// isPlatformManifest returns true if the descriptor in an index refers to an
+// image for a specific platform, rather than something like an attestation
+// manifest
+func isPlatformManifest(desc v1.Descriptor) bool {
+	return desc.MediaType.IsImage() && desc.Platform != nil && desc.Platform.OS != "unknown"
+}
+
+// configPlatform returns the platform described by an image config
+func configPlatform(configFile *v1.ConfigFile) *v1.Platform {
+	return &v1.Platform{
+		OS:           configFile.OS,
+		Architecture: configFile.Architecture,
+		Variant:      configFile.Variant,
+		OSVersion:    configFile.OSVersion,
+	}
 }
 
-// ContainerSpec is information about a container
+// The types of container in a pod
+const (
+	containerTypeInit      = "init"
+	containerTypeSidecar   = "sidecar"
+	containerTypeRegular   = "regular"
+	containerTypeEphemeral = "ephemeral"
+)
+
+// The sources of image references in a pod
+const (
+	sourceContainer = "container"
+	sourceVolume    = "volume"
+)
+
+// ContainerSpec is information about a container, or an image volume
 type ContainerSpec struct {
 	// JSONPath is the path to the container in the object
 	JSONPath string
@@ -261,35 +749,32 @@ type ContainerSpec struct {
 	// Name is the name of the container
 	Name string
 
+	// Type is the type of the container. One of init, sidecar, regular or
+	// ephemeral. It's empty for volumes.
+	Type string
+
+	// Source is where the image reference comes from. Either container or
+	// volume.
+	Source string
+
 	// Image is the image reference
 	Image string
+
+	// RunningImage is a reference to the digest of the image that is
+	// actually running, taken from the container status. It's empty if the
+	// container isn't running or the runtime didn't report a digest.
+	RunningImage string
 }
 
-func containerSpecs(obj *unstructured.Unstructured) []ContainerSpec {
-	// Paths where we will find container specs in various objects
-	containerPaths := [][]string{
-		{
-			"spec", "initContainers",
-		},
-		{
-			"spec", "containers",
-		},
-		{
-			"spec", "ephemeralContainers",
-		},
-		{
-			"spec", "template", "spec", "initContainers",
-		},
-		{
-			"spec", "template", "spec", "containers",
-		},
-		{
-			"spec", "jobTemplate", "spec", "template", "spec", "initContainers",
-		},
-		{
-			"spec", "jobTemplate", "spec", "template", "spec", "containers",
-		},
-	}
+// runningDigest returns the digest of the image that is actually running, or
+// an empty string if it isn't known
+func (c ContainerSpec) runningDigest() string {
+	_, digest, _ := strings.Cut(c.RunningImage, "@")
+
+	return digest
+}
+
+func containerSpecs(obj *unstructured.Unstructured, containerPaths [][]string) []ContainerSpec {
 	var containerSpecs []ContainerSpec
 	for _, containerPath := range containerPaths {
 		containers, _, _ := unstructured.NestedSlice(obj.Object, containerPath...)
@@ -309,6 +794,8 @@ func containerSpecs(obj *unstructured.Unstructured) []ContainerSpec {
 			containerSpecs = append(containerSpecs, ContainerSpec{
 				JSONPath: fmt.Sprintf("{.%s[%d]}", strings.Join(containerPath, "."), i),
 				Name:     name,
+				Type:     containerType(containerPath, data),
+				Source:   sourceContainer,
 				Image:    image,
 			})
 		}
@@ -317,19 +804,107 @@ func containerSpecs(obj *unstructured.Unstructured) []ContainerSpec {
 	return containerSpecs
 }
 
-func imagePullSecrets(obj *unstructured.Unstructured) []string {
-	imagePullSecretsPaths := [][]string{
-		{
-			"spec", "imagePullSecrets",
-		},
-		{
-			"spec", "template", "spec", "imagePullSecrets",
-		},
-		{
-			"spec", "jobTemplate", "spec", "template", "spec", "imagePullSecrets",
-		},
+// volumeSpecs returns the image volumes defined in the object. They're
+// resolved and exported in the same way as containers, but they don't have a
+// type or a running image.
+func volumeSpecs(obj *unstructured.Unstructured, volumesPaths [][]string) []ContainerSpec {
+	var volumeSpecs []ContainerSpec
+	for _, volumesPath := range volumesPaths {
+		volumes, _, _ := unstructured.NestedSlice(obj.Object, volumesPath...)
+		for i, volume := range volumes {
+			data, ok := volume.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, ok := data["name"].(string)
+			if !ok {
+				continue
+			}
+			image, _, _ := unstructured.NestedString(data, "image", "reference")
+			if image == "" {
+				continue
+			}
+			volumeSpecs = append(volumeSpecs, ContainerSpec{
+				JSONPath: fmt.Sprintf("{.%s[%d]}", strings.Join(volumesPath, "."), i),
+				Name:     name,
+				Source:   sourceVolume,
+				Image:    image,
+			})
+		}
+	}
+
+	return volumeSpecs
+}
+
+// containerType returns the type of the container at the path. Init
+// containers that are restarted for the life of the pod are sidecars.
+func containerType(containerPath []string, container map[string]interface{}) string {
+	switch containerPath[len(containerPath)-1] {
+	case "initContainers":
+		if container["restartPolicy"] == string(corev1.ContainerRestartPolicyAlways) {
+			return containerTypeSidecar
+		}
+		return containerTypeInit
+	case "ephemeralContainers":
+		return containerTypeEphemeral
 	}
 
+	return containerTypeRegular
+}
+
+// containerImageIDs returns the imageID from each container status, keyed by
+// the name of the container
+func containerImageIDs(obj *unstructured.Unstructured, containerStatusesPaths [][]string) map[string]string {
+	imageIDs := map[string]string{}
+	for _, containerStatusesPath := range containerStatusesPaths {
+		statuses, _, _ := unstructured.NestedSlice(obj.Object, containerStatusesPath...)
+		for _, status := range statuses {
+			data, ok := status.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, ok := data["name"].(string)
+			if !ok {
+				continue
+			}
+			imageID, ok := data["imageID"].(string)
+			if !ok || imageID == "" {
+				continue
+			}
+			imageIDs[name] = imageID
+		}
+	}
+
+	return imageIDs
+}
+
+// runningImage returns a reference to the digest in imageID, in the
+// repository of the image that the container is configured with so that the
+// same credentials can be used to fetch it. Image IDs that don't include a
+// repository digest, like the local ID of an image that was loaded directly
+// onto the node, are ignored.
+func runningImage(image, imageID string) string {
+	if imageID == "" {
+		return ""
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return ""
+	}
+
+	// Docker prefixes the image ID with the scheme it was pulled with
+	imageID = strings.TrimPrefix(imageID, "docker-pullable://")
+	imageID = strings.TrimPrefix(imageID, "docker://")
+
+	d, err := name.NewDigest(imageID)
+	if err != nil {
+		return ""
+	}
+
+	return ref.Context().Digest(d.DigestStr()).String()
+}
+
+func imagePullSecrets(obj *unstructured.Unstructured, imagePullSecretsPaths [][]string) []string {
 	var secrets []string
 	for _, imagePullSecretsPath := range imagePullSecretsPaths {
 		pullSecrets, _, _ := unstructured.NestedSlice(obj.Object, imagePullSecretsPath...)
@@ -350,19 +925,7 @@ func imagePullSecrets(obj *unstructured.Unstructured) []string {
 	return secrets
 }
 
-func serviceAccountName(obj *unstructured.Unstructured) string {
-	serviceAccountNamePaths := [][]string{
-		{
-			"spec", "serviceAccountName",
-		},
-		{
-			"spec", "template", "spec", "serviceAccountName",
-		},
-		{
-			"spec", "jobTemplate", "spec", "template", "spec", "serviceAccountName",
-		},
-	}
-
+func serviceAccountName(obj *unstructured.Unstructured, serviceAccountNamePaths [][]string) string {
 	for _, serviceAccountNamePath := range serviceAccountNamePaths {
 		serviceAccountName, _, _ := unstructured.NestedString(obj.Object, serviceAccountNamePath...)
 		if serviceAccountName != "" {
@@ -0,0 +1,413 @@
+package controller
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	image, digest := pushImage(t)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: image}},
+		},
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod).Build()
+
+	// Construct the reconciler in the same way as SetupControllers, so that
+	// it shares the exporter's snapshot
+	cache := NewContainerImageCache()
+	exporter := NewExporter(cache, WithResources(DefaultResources))
+	newReconciler, err := reconcilerFactory(c, nil, cache, exporter, newOptions(WithResources(DefaultResources)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+	if _, err := newReconciler(DefaultResources[0]).Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconciling: %s", err)
+	}
+
+	// The container is exported with the digest the tag resolved to
+	var found bool
+	for _, labels := range containerInfo(t, exporter) {
+		if labels["name"] == "app" && labels["container"] == "app" && labels["digest"] == digest.String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("container_image_container_info wasn't exported for %s with digest %s", image, digest)
+	}
+
+	// Deleting the object removes it from the snapshot
+	if err := c.Delete(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newReconciler(DefaultResources[0]).Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconciling deleted object: %s", err)
+	}
+	if objects, _ := exporter.snapshot.list(); len(objects) != 0 {
+		t.Fatalf("expected the snapshot to be empty, got %d objects", len(objects))
+	}
+}
+
+// TestReconcileBestEffort checks that objects are still exported when the
+// lookups that only add details to their metrics fail
+func TestReconcileBestEffort(t *testing.T) {
+	ctx := context.Background()
+	image, digest := pushImage(t)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "ReplicaSet",
+				Name:       "app-abc123",
+				Controller: ptr.To(true),
+			}},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   "node",
+			Containers: []corev1.Container{{Name: "app", Image: image}},
+		},
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading the node and the owner is forbidden
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(pod).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+				switch obj.(type) {
+				case *corev1.Node, *metav1.PartialObjectMetadata:
+					return apierrors.NewForbidden(schema.GroupResource{}, key.Name, nil)
+				}
+				return c.Get(ctx, key, obj, opts...)
+			},
+		}).
+		Build()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+	platform := &v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	t.Run("lookups fail", func(t *testing.T) {
+		cache := NewContainerImageCache()
+		exporter := NewExporter(cache, WithResources(DefaultResources))
+		newReconciler, err := reconcilerFactory(c, nil, cache, exporter, newOptions(WithResources(DefaultResources), WithPlatform(platform)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newReconciler(DefaultResources[0]).Reconcile(ctx, req); err != nil {
+			t.Fatalf("reconciling: %s", err)
+		}
+
+		// The image is resolved and the pod is exported without an owner
+		var found bool
+		for _, labels := range containerInfo(t, exporter) {
+			if labels["name"] != "app" || labels["digest"] != digest.String() {
+				continue
+			}
+			if labels["owner_kind"] != "" || labels["owner_name"] != "" {
+				t.Fatalf("unexpected labels: %v", labels)
+			}
+			found = true
+		}
+		if !found {
+			t.Fatalf("container_image_container_info wasn't exported for %s with digest %s", image, digest)
+		}
+	})
+
+	t.Run("keychain fails", func(t *testing.T) {
+		// Reading the service account is forbidden
+		kubeClient := kubefake.NewClientset()
+		kubeClient.PrependReactor("get", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "serviceaccounts"}, "default", nil)
+		})
+
+		cache := NewContainerImageCache()
+		exporter := NewExporter(cache, WithResources(DefaultResources))
+		newReconciler, err := reconcilerFactory(c, kubeClient, cache, exporter, newOptions(WithResources(DefaultResources), WithK8sKeychain(true)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newReconciler(DefaultResources[0]).Reconcile(ctx, req); err == nil {
+			t.Fatal("expected an error constructing the keychain")
+		}
+
+		// The pod is still exported, without a digest
+		var found bool
+		for _, labels := range containerInfo(t, exporter) {
+			if labels["name"] == "app" && labels["container"] == "app" && labels["digest"] == "" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("container_image_container_info wasn't exported for %s without a digest", image)
+		}
+	})
+}
+
+// TestReconcileRunningDigestNotFound checks that a pod running a build that
+// has been deleted from the registry is reported as drifting
+func TestReconcileRunningDigestNotFound(t *testing.T) {
+	ctx := context.Background()
+	image, digest := pushImage(t)
+
+	// The digest the pod is running isn't in the registry any more
+	runningDigest := "sha256:" + strings.Repeat("a", 64)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: image}},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:    "app",
+				Image:   image,
+				ImageID: strings.Split(image, ":latest")[0] + "@" + runningDigest,
+			}},
+		},
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod).Build()
+
+	cache := NewContainerImageCache()
+	exporter := NewExporter(cache, WithResources(DefaultResources))
+	newReconciler, err := reconcilerFactory(c, nil, cache, exporter, newOptions(WithResources(DefaultResources), WithCacheDuration(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+	result, err := newReconciler(DefaultResources[0]).Reconcile(ctx, req)
+	if err != nil {
+		t.Fatalf("reconciling: %s", err)
+	}
+
+	// The missing running image isn't treated as an error, so the object
+	// is only requeued when the tag needs checking again
+	if result.RequeueAfter < time.Hour {
+		t.Errorf("expected the object to be requeued after the tag cache duration, got %s", result.RequeueAfter)
+	}
+	if errs := gatherLabels(t, exporter, "container_image_resolution_error"); len(errs) != 0 {
+		t.Errorf("expected no resolution errors, got %v", errs)
+	}
+
+	drift := gatherLabels(t, exporter, "container_image_tag_drift")
+	if len(drift) != 1 {
+		t.Fatalf("expected 1 container_image_tag_drift metric, got %d", len(drift))
+	}
+	if drift[0]["running_digest"] != runningDigest || drift[0]["latest_digest"] != digest.String() {
+		t.Errorf("unexpected labels: %v", drift[0])
+	}
+	for _, labels := range containerInfo(t, exporter) {
+		if labels["running_digest"] != runningDigest {
+			t.Errorf("running_digest = %q, want %q", labels["running_digest"], runningDigest)
+		}
+	}
+}
+
+// pushImage pushes a random image to a registry running in the test and
+// returns a reference to it, along with its digest
+func pushImage(t *testing.T) (string, v1.Hash) {
+	t.Helper()
+
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	image := strings.TrimPrefix(srv.URL, "http://") + "/app:latest"
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return image, digest
+}
+
+// containerInfo returns the labels of every container_image_container_info
+// metric the exporter collects
+func containerInfo(t *testing.T, exporter *Exporter) []map[string]string {
+	t.Helper()
+
+	return gatherLabels(t, exporter, "container_image_container_info")
+}
+
+// gatherLabels returns the labels of every metric in the family that the
+// exporter collects
+func gatherLabels(t *testing.T, exporter *Exporter, family string) []map[string]string {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(exporter)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics []map[string]string
+	for _, f := range families {
+		if f.GetName() != family {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			metrics = append(metrics, labels)
+		}
+	}
+
+	return metrics
+}
+
+// TestReconcileIndexWithMissingImage checks that an image in an index that
+// can't be fetched doesn't stop the index being exported, and that it's
+// cached once it can be fetched
+func TestReconcileIndexWithMissingImage(t *testing.T) {
+	ctx := context.Background()
+
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+	image := strings.TrimPrefix(srv.URL, "http://") + "/app:latest"
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64"}
+	amd64Img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64Img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64Img, Descriptor: v1.Descriptor{Platform: &amd64}},
+		mutate.IndexAddendum{Add: arm64Img, Descriptor: v1.Descriptor{Platform: &arm64}},
+	)
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the arm64 image from the registry
+	arm64Digest, err := arm64Img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64Ref := ref.Context().Digest(arm64Digest.String())
+	if err := remote.Delete(arm64Ref); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: image}},
+		},
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod).Build()
+
+	// The tag is revalidated on every reconcile
+	cache := NewContainerImageCache()
+	exporter := NewExporter(cache, WithResources(DefaultResources))
+	opts := newOptions(
+		WithResources(DefaultResources),
+		WithPlatform(&amd64),
+		WithAllPlatforms(true),
+		WithCacheDuration(time.Nanosecond),
+	)
+	newReconciler, err := reconcilerFactory(c, nil, cache, exporter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+	if _, err := newReconciler(DefaultResources[0]).Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconciling: %s", err)
+	}
+
+	// The index is exported without the arm64 image
+	var found bool
+	for _, labels := range containerInfo(t, exporter) {
+		if labels["name"] == "app" && labels["digest"] == digest.String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("container_image_container_info wasn't exported for %s with digest %s", image, digest)
+	}
+	if _, err := cache.Get(ctx, arm64Ref, &arm64); err == nil {
+		t.Fatal("expected the arm64 image not to be cached")
+	}
+
+	// Once the arm64 image is back, it's cached when the tag is
+	// revalidated, even though the tag hasn't moved
+	if err := remote.Write(arm64Ref, arm64Img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newReconciler(DefaultResources[0]).Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconciling: %s", err)
+	}
+	if _, err := cache.Get(ctx, arm64Ref, &arm64); err != nil {
+		t.Fatalf("expected the arm64 image to be cached: %s", err)
+	}
+}
@@ -0,0 +1,326 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Resource describes a kind of Kubernetes object that defines containers and
+// where the container specs can be found in it
+type Resource struct {
+	// Group is the API group of the resource
+	Group string `json:"group"`
+
+	// Version is the API version of the resource
+	Version string `json:"version"`
+
+	// Kind is the kind of the resource
+	Kind string `json:"kind"`
+
+	// PodSpecPaths are dot separated paths to pod specs in the object (i.e
+	// spec.template.spec). The containers, pull secrets and service account
+	// name in each pod spec are discovered automatically.
+	PodSpecPaths []string `json:"podSpecPaths,omitempty"`
+
+	// ContainerPaths are dot separated paths to additional arrays of
+	// containers in the object
+	ContainerPaths []string `json:"containerPaths,omitempty"`
+
+	// ImagePullSecretsPaths are dot separated paths to additional arrays of
+	// image pull secret references in the object
+	ImagePullSecretsPaths []string `json:"imagePullSecretsPaths,omitempty"`
+
+	// ServiceAccountNamePaths are dot separated paths to additional service
+	// account names in the object
+	ServiceAccountNamePaths []string `json:"serviceAccountNamePaths,omitempty"`
+
+	// VolumesPaths are dot separated paths to additional arrays of volumes
+	// in the object. The image.reference of each image volume is exported
+	// with the containers.
+	VolumesPaths []string `json:"volumesPaths,omitempty"`
+
+	// DesiredReplicasPath is a dot separated path to the number of replicas
+	// that the object should be running (i.e spec.replicas)
+	DesiredReplicasPath string `json:"desiredReplicasPath,omitempty"`
+
+	// ReadyReplicasPath is a dot separated path to the number of replicas
+	// that are ready (i.e status.readyReplicas)
+	ReadyReplicasPath string `json:"readyReplicasPath,omitempty"`
+
+	// ContainerStatusesPaths are dot separated paths to arrays of container
+	// statuses in the object. The imageID in each status is matched to the
+	// container with the same name.
+	ContainerStatusesPaths []string `json:"containerStatusesPaths,omitempty"`
+}
+
+// DefaultResources are the resources that are watched when none are
+// configured
+var DefaultResources = []Resource{
+	{
+		Group:        "",
+		Version:      "v1",
+		Kind:         "Pod",
+		PodSpecPaths: []string{"spec"},
+		ContainerStatusesPaths: []string{
+			"status.initContainerStatuses",
+			"status.containerStatuses",
+			"status.ephemeralContainerStatuses",
+		},
+	},
+	{
+		Group:               "apps",
+		Version:             "v1",
+		Kind:                "Deployment",
+		PodSpecPaths:        []string{"spec.template.spec"},
+		DesiredReplicasPath: "spec.replicas",
+		ReadyReplicasPath:   "status.readyReplicas",
+	},
+	{
+		Group:               "apps",
+		Version:             "v1",
+		Kind:                "StatefulSet",
+		PodSpecPaths:        []string{"spec.template.spec"},
+		DesiredReplicasPath: "spec.replicas",
+		ReadyReplicasPath:   "status.readyReplicas",
+	},
+	{
+		Group:               "apps",
+		Version:             "v1",
+		Kind:                "DaemonSet",
+		PodSpecPaths:        []string{"spec.template.spec"},
+		DesiredReplicasPath: "status.desiredNumberScheduled",
+		ReadyReplicasPath:   "status.numberReady",
+	},
+	{
+		Group:               "apps",
+		Version:             "v1",
+		Kind:                "ReplicaSet",
+		PodSpecPaths:        []string{"spec.template.spec"},
+		DesiredReplicasPath: "spec.replicas",
+		ReadyReplicasPath:   "status.readyReplicas",
+	},
+	{
+		Group:               "",
+		Version:             "v1",
+		Kind:                "ReplicationController",
+		PodSpecPaths:        []string{"spec.template.spec"},
+		DesiredReplicasPath: "spec.replicas",
+		ReadyReplicasPath:   "status.readyReplicas",
+	},
+	{
+		Group:        "batch",
+		Version:      "v1",
+		Kind:         "Job",
+		PodSpecPaths: []string{"spec.template.spec"},
+	},
+	{
+		Group:        "batch",
+		Version:      "v1",
+		Kind:         "CronJob",
+		PodSpecPaths: []string{"spec.jobTemplate.spec.template.spec"},
+	},
+}
+
+// GroupVersionKind returns the GroupVersionKind of the resource
+func (r Resource) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{
+		Group:   r.Group,
+		Version: r.Version,
+		Kind:    r.Kind,
+	}
+}
+
+// Validate checks that the resource is correctly defined
+func (r Resource) Validate() error {
+	if r.Version == "" {
+		return fmt.Errorf("version must be set")
+	}
+	if r.Kind == "" {
+		return fmt.Errorf("kind must be set")
+	}
+	if len(r.PodSpecPaths) == 0 && len(r.ContainerPaths) == 0 {
+		return fmt.Errorf("%s: one of podSpecPaths or containerPaths must be set", r.GroupVersionKind())
+	}
+
+	return nil
+}
+
+// controllerName is a unique name for the controller that reconciles the
+// resource
+func (r Resource) controllerName() string {
+	if r.Group == "" {
+		return strings.ToLower(r.Kind)
+	}
+
+	return strings.ToLower(r.Kind + "." + r.Group)
+}
+
+// containerSpecs returns the containers and image volumes defined in the
+// object
+func (r Resource) containerSpecs(obj *unstructured.Unstructured) []ContainerSpec {
+	var containerPaths [][]string
+	for _, podSpecPath := range splitPaths(r.PodSpecPaths) {
+		for _, field := range []string{"initContainers", "containers", "ephemeralContainers"} {
+			containerPaths = append(containerPaths, appendPath(podSpecPath, field))
+		}
+	}
+	containerPaths = append(containerPaths, splitPaths(r.ContainerPaths)...)
+
+	var volumesPaths [][]string
+	for _, podSpecPath := range splitPaths(r.PodSpecPaths) {
+		volumesPaths = append(volumesPaths, appendPath(podSpecPath, "volumes"))
+	}
+	volumesPaths = append(volumesPaths, splitPaths(r.VolumesPaths)...)
+
+	specs := containerSpecs(obj, containerPaths)
+
+	imageIDs := containerImageIDs(obj, splitPaths(r.ContainerStatusesPaths))
+	for i, spec := range specs {
+		specs[i].RunningImage = runningImage(spec.Image, imageIDs[spec.Name])
+	}
+
+	return append(specs, volumeSpecs(obj, volumesPaths)...)
+}
+
+// replicas returns the number of replicas that the object should be running
+// and how many of them are ready, keyed by the state, for the paths that are
+// configured. Fields that haven't been set yet, like the status of a new
+// object, are counted as 0.
+func (r Resource) replicas(obj *unstructured.Unstructured) map[string]int64 {
+	paths := map[string]string{
+		replicasDesired: r.DesiredReplicasPath,
+		replicasReady:   r.ReadyReplicasPath,
+	}
+	var replicas map[string]int64
+	for state, path := range paths {
+		if path == "" {
+			continue
+		}
+		if replicas == nil {
+			replicas = map[string]int64{}
+		}
+		replicas[state] = nestedCount(obj, path)
+	}
+
+	return replicas
+}
+
+// The states of the replicas of an object
+const (
+	replicasDesired = "desired"
+	replicasReady   = "ready"
+)
+
+// nestedCount returns the integer at the dot separated path, or 0 if it
+// isn't set
+func nestedCount(obj *unstructured.Unstructured, path string) int64 {
+	n, _, _ := unstructured.NestedInt64(obj.Object, strings.Split(path, ".")...)
+
+	return n
+}
+
+// imagePullSecrets returns the names of the pull secrets referenced by the
+// object
+func (r Resource) imagePullSecrets(obj *unstructured.Unstructured) []string {
+	var imagePullSecretsPaths [][]string
+	for _, podSpecPath := range splitPaths(r.PodSpecPaths) {
+		imagePullSecretsPaths = append(imagePullSecretsPaths, appendPath(podSpecPath, "imagePullSecrets"))
+	}
+	imagePullSecretsPaths = append(imagePullSecretsPaths, splitPaths(r.ImagePullSecretsPaths)...)
+
+	return imagePullSecrets(obj, imagePullSecretsPaths)
+}
+
+// serviceAccountName returns the name of the service account referenced by
+// the object
+func (r Resource) serviceAccountName(obj *unstructured.Unstructured) string {
+	var serviceAccountNamePaths [][]string
+	for _, podSpecPath := range splitPaths(r.PodSpecPaths) {
+		serviceAccountNamePaths = append(serviceAccountNamePaths, appendPath(podSpecPath, "serviceAccountName"))
+	}
+	serviceAccountNamePaths = append(serviceAccountNamePaths, splitPaths(r.ServiceAccountNamePaths)...)
+
+	return serviceAccountName(obj, serviceAccountNamePaths)
+}
+
+func splitPaths(paths []string) [][]string {
+	var split [][]string
+	for _, path := range paths {
+		split = append(split, strings.Split(path, "."))
+	}
+
+	return split
+}
+
+// appendPath returns a copy of path with the fields appended to it, so that
+// the original backing array is never shared between paths
+func appendPath(path []string, fields ...string) []string {
+	return append(append([]string{}, path...), fields...)
+}
+
+// resourceSet is a set of resources that can be modified while the
+// controllers are running
+type resourceSet struct {
+	resources map[schema.GroupVersionKind]Resource
+	lock      sync.RWMutex
+}
+
+func newResourceSet(resources []Resource) *resourceSet {
+	s := &resourceSet{
+		resources: map[schema.GroupVersionKind]Resource{},
+	}
+	for _, resource := range resources {
+		s.add(resource)
+	}
+
+	return s
+}
+
+func (s *resourceSet) add(resource Resource) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.resources[resource.GroupVersionKind()] = resource
+}
+
+func (s *resourceSet) remove(gvk schema.GroupVersionKind) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.resources, gvk)
+}
+
+// hasGroupKind returns true if any version of the kind is in the set
+func (s *resourceSet) hasGroupKind(gk schema.GroupKind) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for gvk := range s.resources {
+		if gvk.GroupKind() == gk {
+			return true
+		}
+	}
+
+	return false
+}
+
+// list returns the resources in the set, sorted by their GroupVersionKind
+func (s *resourceSet) list() []Resource {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	resources := make([]Resource, 0, len(s.resources))
+	for _, resource := range s.resources {
+		resources = append(resources, resource)
+	}
+	slices.SortFunc(resources, func(a, b Resource) int {
+		return strings.Compare(a.GroupVersionKind().String(), b.GroupVersionKind().String())
+	})
+
+	return resources
+}
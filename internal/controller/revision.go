@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// revisionAnnotation is set on Deployments and their ReplicaSets by the
+// Deployment controller. The ReplicaSet with the same revision as its
+// Deployment is the current one.
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+var (
+	replicaSetGroupKind = schema.GroupKind{Group: "apps", Kind: "ReplicaSet"}
+	deploymentGroupKind = schema.GroupKind{Group: "apps", Kind: "Deployment"}
+)
+
+// currentRevision returns "true" if the object is a ReplicaSet that is the
+// current revision of the Deployment that controls it and "false" if it's an
+// older revision. It returns an empty string for anything else, or if the
+// Deployment can't be read, in which case the error is logged.
+func currentRevision(ctx context.Context, c client.Reader, obj *unstructured.Unstructured) string {
+	if obj.GroupVersionKind().GroupKind() != replicaSetGroupKind {
+		return ""
+	}
+	ref := metav1.GetControllerOf(obj)
+	if ref == nil {
+		return ""
+	}
+	logger := ctrl.Log.WithValues("namespace", obj.GetNamespace(), "name", obj.GetName())
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		logger.Error(err, "Failed to parse api version of owner", "owner", ref.Name)
+		return ""
+	}
+	if gv.WithKind(ref.Kind).GroupKind() != deploymentGroupKind {
+		return ""
+	}
+
+	deployment := &metav1.PartialObjectMetadata{}
+	deployment.SetGroupVersionKind(gv.WithKind(ref.Kind))
+	if err := c.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: ref.Name}, deployment); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "Failed to get deployment", "deployment", ref.Name)
+		}
+		return ""
+	}
+
+	revision := obj.GetAnnotations()[revisionAnnotation]
+	if revision == "" {
+		return ""
+	}
+
+	return strconv.FormatBool(revision == deployment.GetAnnotations()[revisionAnnotation])
+}
+
+// hasReplicas returns true if the object reports that it has any replicas
+// in its status
+func hasReplicas(obj *unstructured.Unstructured) bool {
+	replicas, _, _ := unstructured.NestedInt64(obj.Object, "status", "replicas")
+
+	return replicas > 0
+}
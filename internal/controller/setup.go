@@ -2,80 +2,20 @@ package controller
 
 import (
 	"fmt"
-	"time"
 
-	appsv1 "k8s.io/api/apps/v1"
-	batchv1 "k8s.io/api/batch/v1"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
-var resources = []struct {
-	Object           client.Object
-	GroupVersionKind schema.GroupVersionKind
-}{
-	{
-		Object: &corev1.Pod{},
-		GroupVersionKind: schema.GroupVersionKind{
-			Group:   "",
-			Version: "v1",
-			Kind:    "Pod",
-		},
-	},
-	{
-		Object: &appsv1.Deployment{},
-		GroupVersionKind: schema.GroupVersionKind{
-			Group:   "apps",
-			Version: "v1",
-			Kind:    "Deployment",
-		},
-	},
-	{
-		Object: &appsv1.StatefulSet{},
-		GroupVersionKind: schema.GroupVersionKind{
-			Group:   "apps",
-			Version: "v1",
-			Kind:    "StatefulSet",
-		},
-	},
-	{
-		Object: &appsv1.DaemonSet{},
-		GroupVersionKind: schema.GroupVersionKind{
-			Group:   "apps",
-			Version: "v1",
-			Kind:    "DaemonSet",
-		},
-	},
-	{
-		Object: &batchv1.Job{},
-		GroupVersionKind: schema.GroupVersionKind{
-			Group:   "batch",
-			Version: "v1",
-			Kind:    "Job",
-		},
-	},
-	{
-		Object: &batchv1.CronJob{},
-		GroupVersionKind: schema.GroupVersionKind{
-			Group:   "batch",
-			Version: "v1",
-			Kind:    "CronJob",
-		},
-	},
-}
-
 // SetupControllers constructs and registers controllers
 func SetupControllers(mgr ctrl.Manager, opts ...Option) error {
-	o := &options{
-		cacheDuration: 1 * time.Hour,
-	}
-	for _, opt := range opts {
-		opt(o)
-	}
+	o := newOptions(opts...)
 
 	// We use this Kubernetes client to fetch pull secrets
 	kubeClient, err := kubernetes.NewForConfig(mgr.GetConfig())
@@ -85,24 +25,112 @@ func SetupControllers(mgr ctrl.Manager, opts ...Option) error {
 
 	// Avoid requesting information about the same images multiple times by
 	// caching the responses.
-	cache := NewContainerImageCache()
-	for _, resource := range resources {
-		reconciler := &ContainerImageReconciler{
-			Client:           mgr.GetClient(),
-			KubeClient:       kubeClient,
-			GroupVersionKind: resource.GroupVersionKind,
-			Cache:            cache,
-			CacheDuration:    o.cacheDuration,
-			Platform:         o.platform,
-			K8sKeychain:      o.k8sKeychain,
+	cache := o.cache
+	if cache == nil {
+		cache = NewContainerImageCache()
+	}
+
+	// The exporter renders the snapshot of objects that the reconcilers
+	// maintain, and reports the images that they failed to resolve
+	exporter := NewExporter(cache, opts...)
+
+	newReconciler, err := reconcilerFactory(mgr.GetClient(), kubeClient, cache, exporter, o)
+	if err != nil {
+		return err
+	}
+	for _, resource := range o.resources {
+		reconciler := newReconciler(resource)
+
+		// The objects are handled as unstructured so that any kind which
+		// embeds containers can be watched, including custom resources
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(resource.GroupVersionKind())
+		if err := ctrl.NewControllerManagedBy(mgr).For(obj).Named(resource.controllerName()).Complete(reconciler); err != nil {
+			return fmt.Errorf("unable to create controller for %s: %w", resource.GroupVersionKind(), err)
+		}
+	}
+
+	// Start watching custom resources as they are added to the cluster
+	if o.discovery {
+		if err := mgr.Add(&CustomResourceDiscoverer{
+			mgr:           mgr,
+			resources:     exporter.resources,
+			snapshot:      exporter.snapshot,
+			newReconciler: newReconciler,
+			controllers:   map[string]*discoveredController{},
+		}); err != nil {
+			return fmt.Errorf("adding custom resource discoverer: %w", err)
 		}
-		if err := ctrl.NewControllerManagedBy(mgr).For(resource.Object).Complete(reconciler); err != nil {
-			return fmt.Errorf("unable to create controller for %s: %w", resource.GroupVersionKind, err)
+	}
+
+	// Remove images from the cache once they're no longer in use
+	if o.gracePeriod > 0 {
+		if err := mgr.Add(&cacheCollector{
+			snapshot:    exporter.snapshot,
+			cache:       cache,
+			gracePeriod: o.gracePeriod,
+			errors:      exporter.resolutionErrors,
+		}); err != nil {
+			return fmt.Errorf("adding cache collector: %w", err)
 		}
 	}
 
-	// Register an exporter with the controller-runtime Prometheus registry
-	metrics.Registry.Register(NewExporter(mgr.GetClient(), cache))
+	// Register the exporter and the cache metrics with the
+	// controller-runtime Prometheus registry
+	collectors := []prometheus.Collector{
+		exporter,
+		cacheEntries,
+		cacheEvictions,
+		resolutionFailures,
+		registryRequests,
+		registryRequestDuration,
+		registryResponseBytes,
+		registryRateLimit,
+		registryRateLimitRemaining,
+		registryLimiterWait,
+	}
+	for _, c := range collectors {
+		if err := metrics.Registry.Register(c); err != nil {
+			return fmt.Errorf("registering metrics: %w", err)
+		}
+	}
 
 	return nil
 }
+
+// reconcilerFactory returns a function that constructs the reconciler for a
+// resource. Every reconciler shares the cache, the snapshot and resolution
+// errors of the exporter, the registry limits and the in-flight fetches.
+func reconcilerFactory(c client.Client, kubeClient kubernetes.Interface, cache ContainerImageCache, exporter *Exporter, o *options) (func(Resource) reconcile.Reconciler, error) {
+	// The limits for each registry apply across every reconciler
+	registryLimiters := newRegistryLimiters(o.defaultRegistryLimit, o.registryLimits)
+
+	tagCacheDurations, err := newTagCacheDurations(o.cacheDuration, o.tagCacheDurations)
+	if err != nil {
+		return nil, err
+	}
+
+	// Concurrent fetches of the same image are coalesced across every
+	// reconciler
+	fetches := &singleflight.Group{}
+
+	return func(resource Resource) reconcile.Reconciler {
+		return &ContainerImageReconciler{
+			Client:              c,
+			KubeClient:          kubeClient,
+			Resource:            resource,
+			Cache:               cache,
+			CacheDuration:       o.cacheDuration,
+			DigestCacheDuration: o.digestCacheDuration,
+			Platform:            o.platform,
+			K8sKeychain:         o.k8sKeychain,
+			AllPlatforms:        o.allPlatforms,
+
+			tagCacheDurations: tagCacheDurations,
+			resolutionErrors:  exporter.resolutionErrors,
+			registryLimiters:  registryLimiters,
+			fetches:           fetches,
+			snapshot:          exporter.snapshot,
+		}
+	}, nil
+}
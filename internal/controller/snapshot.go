@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// snapshot is an index of the containers in every object that the reconcilers
+// have seen, along with the images they resolved to. The reconcilers update it
+// as objects change, so that the exporter can render metrics from it without
+// listing every object on each scrape.
+type snapshot struct {
+	objects map[snapshotKey]snapshotObject
+	updated time.Time
+	lock    sync.RWMutex
+}
+
+type snapshotKey struct {
+	gvk schema.GroupVersionKind
+	types.NamespacedName
+}
+
+// snapshotObject is an object in the snapshot
+type snapshotObject struct {
+	snapshotKey
+
+	// owner is the top-level object that controls the object, if there is
+	// one
+	owner *objectOwner
+
+	// currentRevision is true or false for ReplicaSets that are controlled
+	// by a Deployment, depending on whether they're the current revision
+	// of it, and empty for everything else
+	currentRevision string
+
+	// replicas are the desired and ready replicas of the object, keyed by
+	// the state, if it has them
+	replicas map[string]int64
+
+	containers []snapshotContainer
+}
+
+// snapshotContainer is a container and the images that it resolved to. The
+// images are nil if they haven't been resolved.
+type snapshotContainer struct {
+	ContainerSpec
+	image        *ContainerImage
+	runningImage *ContainerImage
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{
+		objects: map[snapshotKey]snapshotObject{},
+		updated: time.Now(),
+	}
+}
+
+// set replaces an object
+func (s *snapshot) set(obj snapshotObject) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.objects[obj.snapshotKey] = obj
+	s.updated = time.Now()
+}
+
+// delete removes an object
+func (s *snapshot) delete(gvk schema.GroupVersionKind, nn types.NamespacedName) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.objects, snapshotKey{gvk: gvk, NamespacedName: nn})
+	s.updated = time.Now()
+}
+
+// deleteKind removes every object of a kind, when it's no longer watched
+func (s *snapshot) deleteKind(gvk schema.GroupVersionKind) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key := range s.objects {
+		if key.gvk == gvk {
+			delete(s.objects, key)
+		}
+	}
+	s.updated = time.Now()
+}
+
+// list returns every object in the snapshot and how long ago the snapshot was
+// last updated
+func (s *snapshot) list() ([]snapshotObject, time.Duration) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	objects := make([]snapshotObject, 0, len(s.objects))
+	for _, obj := range s.objects {
+		objects = append(objects, obj)
+	}
+
+	return objects, time.Since(s.updated)
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// The types of endpoint that requests are made to
+const (
+	endpointManifest = "manifest"
+	endpointBlob     = "blob"
+	endpointToken    = "token"
+	endpointPing     = "ping"
+	endpointOther    = "other"
+)
+
+// registryTransport is the transport used for every request to a registry
+var registryTransport http.RoundTripper = &instrumentedTransport{next: remote.DefaultTransport}
+
+// instrumentedTransport records metrics about the requests made to registries
+// and refuses to make requests to registries that are rate limiting us
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip makes a request and records how long it took, the status code,
+// the number of bytes in the response body and any rate limits. Requests
+// aren't made while the registry of the image they're for is paused, so
+// that an image that's already being fetched stops as soon as the registry
+// asks us to back off.
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	registry := registryFromContext(req.Context(), req.URL.Host)
+	if until, ok := pausedRegistries.pausedUntil(registry); ok {
+		return nil, &registryPausedError{registry: registry, until: until}
+	}
+
+	host := req.URL.Host
+	endpoint := endpointType(req)
+
+	credentialFromContext(req.Context()).observe(req)
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	registryRequestDuration.WithLabelValues(host, req.Method, endpoint).Observe(time.Since(start).Seconds())
+
+	// Requests that fail without a response, like a connection error, are
+	// recorded with a code of "error"
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	registryRequests.WithLabelValues(host, req.Method, endpoint, code).Inc()
+	if err != nil {
+		return resp, err
+	}
+
+	observeRateLimit(req, resp)
+
+	resp.Body = &countingReadCloser{
+		ReadCloser: resp.Body,
+		host:       host,
+		endpoint:   endpoint,
+	}
+
+	return resp, nil
+}
+
+// endpointType returns the type of endpoint that the request is for, based on
+// the path in the distribution API
+func endpointType(req *http.Request) string {
+	path := req.URL.Path
+	switch {
+	case path == "/v2/" || path == "/v2":
+		return endpointPing
+	case strings.HasPrefix(path, "/v2/") && strings.Contains(path, "/manifests/"):
+		return endpointManifest
+	case strings.HasPrefix(path, "/v2/") && strings.Contains(path, "/blobs/"):
+		return endpointBlob
+	case req.URL.Query().Has("scope") || req.URL.Query().Has("service") || strings.HasSuffix(path, "/token"):
+		return endpointToken
+	}
+
+	return endpointOther
+}
+
+// countingReadCloser counts the bytes that are read from a response body
+type countingReadCloser struct {
+	io.ReadCloser
+	host     string
+	endpoint string
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		registryResponseBytes.WithLabelValues(c.host, c.endpoint).Add(float64(n))
+	}
+
+	return n, err
+}
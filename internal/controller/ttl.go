@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TagCacheDuration overrides how long the digest that a tag resolves to is
+// cached for, for the tags in a registry or that match a pattern
+type TagCacheDuration struct {
+	// Registry is the registry host that the duration applies to, like
+	// index.docker.io
+	Registry string `json:"registry,omitempty"`
+
+	// Pattern is a regular expression that is matched against the fully
+	// qualified reference, like index.docker.io/library/nginx:latest
+	Pattern string `json:"pattern,omitempty"`
+
+	// Duration is how long the digest is cached for
+	Duration metav1.Duration `json:"duration"`
+}
+
+// Validate the tag cache duration
+func (t TagCacheDuration) Validate() error {
+	if t.Registry == "" && t.Pattern == "" {
+		return fmt.Errorf("one of registry or pattern must be set")
+	}
+	if _, err := regexp.Compile(t.Pattern); err != nil {
+		return fmt.Errorf("parsing pattern: %w", err)
+	}
+	if t.Duration.Duration <= 0 {
+		return fmt.Errorf("duration must be greater than 0")
+	}
+
+	return nil
+}
+
+// tagCacheDurations decides how long the digest that a tag resolves to is
+// cached for
+type tagCacheDurations struct {
+	defaultDuration time.Duration
+	overrides       []tagCacheDuration
+}
+
+type tagCacheDuration struct {
+	registry string
+	pattern  *regexp.Regexp
+	duration time.Duration
+}
+
+func newTagCacheDurations(defaultDuration time.Duration, overrides []TagCacheDuration) (*tagCacheDurations, error) {
+	t := &tagCacheDurations{
+		defaultDuration: defaultDuration,
+	}
+	for i, override := range overrides {
+		if err := override.Validate(); err != nil {
+			return nil, fmt.Errorf("validating tag cache duration %d: %w", i, err)
+		}
+		var pattern *regexp.Regexp
+		if override.Pattern != "" {
+			pattern = regexp.MustCompile(override.Pattern)
+		}
+		t.overrides = append(t.overrides, tagCacheDuration{
+			registry: override.Registry,
+			pattern:  pattern,
+			duration: override.Duration.Duration,
+		})
+	}
+
+	return t, nil
+}
+
+// duration returns how long the reference is cached for. The first override
+// that matches the reference is used, otherwise the default.
+func (t *tagCacheDurations) duration(ref name.Reference) time.Duration {
+	for _, override := range t.overrides {
+		if override.registry != "" && override.registry != ref.Context().RegistryStr() {
+			continue
+		}
+		if override.pattern != nil && !override.pattern.MatchString(ref.Name()) {
+			continue
+		}
+		return override.duration
+	}
+
+	return t.defaultDuration
+}
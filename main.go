@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -10,14 +11,18 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
+	"github.com/ribbybibby/container-image-exporter/internal/config"
 	"github.com/ribbybibby/container-image-exporter/internal/controller"
 )
 
@@ -30,14 +35,31 @@ func init() {
 	utilruntime.Must(corev1.AddToScheme(scheme))
 	utilruntime.Must(appsv1.AddToScheme(scheme))
 	utilruntime.Must(batchv1.AddToScheme(scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
 }
 
 var (
-	metricsAddr   string
-	probeAddr     string
-	cacheDuration time.Duration
-	platform      string
-	k8sKeychain   bool
+	metricsAddr          string
+	probeAddr            string
+	cacheDuration        time.Duration
+	digestCacheDuration  time.Duration
+	platform             string
+	k8sKeychain          bool
+	configFile           string
+	discovery            bool
+	allPlatforms         bool
+	cacheBackend         string
+	cacheFile            string
+	cacheNamespace       string
+	cacheConfigMapName   string
+	cacheConfigMapShards int
+	cacheGCGracePeriod   time.Duration
+	cacheMaxEntries      int
+	registryQPS          float64
+	registryBurst        int
+	registryMaxInFlight  int
+	ksmLabels            bool
+	excludeOwnedPods     bool
 )
 
 var rootCmd = &cobra.Command{
@@ -48,17 +70,67 @@ var rootCmd = &cobra.Command{
 
 		ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-		mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		cfg := &config.Config{}
+		if configFile != "" {
+			var err error
+			cfg, err = config.Load(configFile)
+			if err != nil {
+				return fmt.Errorf("loading config: %w", err)
+			}
+		}
+
+		ctx := ctrl.SetupSignalHandler()
+		restConfig := ctrl.GetConfigOrDie()
+
+		mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 			Scheme: scheme,
 			Metrics: metricsserver.Options{
 				BindAddress: metricsAddr,
 			},
 			HealthProbeBindAddress: probeAddr,
+			Client: client.Options{
+				// Read the objects we watch from the informer cache
+				// rather than directly from the API server
+				Cache: &client.CacheOptions{
+					Unstructured: true,
+				},
+			},
 		})
 		if err != nil {
 			return fmt.Errorf("creating a new manager: %w", err)
 		}
 
+		cacheOpts := []controller.CacheOption{
+			controller.WithMaxEntries(cacheMaxEntries),
+		}
+		var cache controller.ContainerImageCache
+		switch cacheBackend {
+		case "memory":
+			cache = controller.NewContainerImageCache(cacheOpts...)
+		case "file":
+			cache, err = controller.NewFileContainerImageCache(cacheFile, cacheOpts...)
+			if err != nil {
+				return fmt.Errorf("creating file cache: %w", err)
+			}
+		case "configmap":
+			if cacheNamespace == "" {
+				cacheNamespace, err = inClusterNamespace()
+				if err != nil {
+					return fmt.Errorf("finding the namespace for the cache: %w", err)
+				}
+			}
+			kubeClient, err := kubernetes.NewForConfig(restConfig)
+			if err != nil {
+				return fmt.Errorf("creating kubernetes client: %w", err)
+			}
+			cache, err = controller.NewConfigMapContainerImageCache(ctx, kubeClient, cacheNamespace, cacheConfigMapName, cacheConfigMapShards, cacheOpts...)
+			if err != nil {
+				return fmt.Errorf("creating configmap cache: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown cache backend: %s", cacheBackend)
+		}
+
 		var p *v1.Platform
 		if platform != "" {
 			p, err = v1.ParsePlatform(platform)
@@ -70,8 +142,22 @@ var rootCmd = &cobra.Command{
 		if err = controller.SetupControllers(
 			mgr,
 			controller.WithCacheDuration(cacheDuration),
+			controller.WithDigestCacheDuration(digestCacheDuration),
+			controller.WithTagCacheDurations(cfg.TagCacheDurations),
 			controller.WithK8sKeychain(k8sKeychain),
 			controller.WithPlatform(p),
+			controller.WithResources(cfg.Resources),
+			controller.WithDiscovery(discovery),
+			controller.WithAllPlatforms(allPlatforms),
+			controller.WithCache(cache),
+			controller.WithCacheGracePeriod(cacheGCGracePeriod),
+			controller.WithKubeStateMetricsLabels(ksmLabels),
+			controller.WithExcludeOwnedPods(excludeOwnedPods),
+			controller.WithRegistryLimits(controller.RegistryLimit{
+				QPS:         registryQPS,
+				Burst:       registryBurst,
+				MaxInFlight: registryMaxInFlight,
+			}, cfg.Registries),
 		); err != nil {
 			return fmt.Errorf("setting up controllers: %w", err)
 		}
@@ -83,7 +169,7 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("adding readyz check: %w", err)
 		}
 
-		return mgr.Start(ctrl.SetupSignalHandler())
+		return mgr.Start(ctx)
 	},
 }
 
@@ -91,10 +177,37 @@ func init() {
 	rootCmd.Flags().StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	rootCmd.Flags().StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	rootCmd.Flags().StringVar(&platform, "platform", "linux/amd64", "The default platform to resolve multi-arch images to.")
-	rootCmd.Flags().DurationVar(&cacheDuration, "cache-duration", 1*time.Hour, "How long to cache image details for before querying the registry again.")
+	rootCmd.Flags().BoolVar(&allPlatforms, "all-platforms", false, "Whether to fetch and export every platform in multi-arch images, in addition to the platform they resolve to.")
+	rootCmd.Flags().DurationVar(&cacheDuration, "cache-duration", 1*time.Hour, "How long to cache the digest that a tag resolves to before checking the registry again.")
+	rootCmd.Flags().DurationVar(&digestCacheDuration, "digest-cache-duration", 0, "How long to cache the details of a digest before fetching them again. Set to 0 to never expire them.")
+	rootCmd.Flags().StringVar(&configFile, "config", "", "Path to a configuration file that defines the resources to export container images from, the limits for each registry and the cache durations for tags.")
+	rootCmd.Flags().BoolVar(&discovery, "discover-custom-resources", false, "Whether to discover custom resources that embed pod specs and export their container images.")
+	rootCmd.Flags().StringVar(&cacheBackend, "cache-backend", "memory", "Where to cache image details. One of: memory, file, configmap.")
+	rootCmd.Flags().StringVar(&cacheFile, "cache-file", "/var/cache/container-image-exporter/cache.jsonl", "The file to persist the cache to when --cache-backend=file.")
+	rootCmd.Flags().StringVar(&cacheNamespace, "cache-namespace", "", "The namespace to store the cache in when --cache-backend=configmap. Defaults to the namespace the exporter is running in.")
+	rootCmd.Flags().StringVar(&cacheConfigMapName, "cache-configmap-name", "container-image-exporter-cache", "The prefix of the names of the ConfigMaps that store the cache when --cache-backend=configmap.")
+	rootCmd.Flags().IntVar(&cacheConfigMapShards, "cache-configmap-shards", 16, "The number of ConfigMaps to shard the cache across when --cache-backend=configmap.")
+	rootCmd.Flags().DurationVar(&cacheGCGracePeriod, "cache-gc-grace-period", 24*time.Hour, "How long an image can go unreferenced by any object before it's removed from the cache. Set to 0 to disable.")
+	rootCmd.Flags().BoolVar(&ksmLabels, "kube-state-metrics-labels", false, "Add a pod label to container_image_container_info for Pods, so that it can be joined to kube-state-metrics and cAdvisor series on namespace, pod and container.")
+	rootCmd.Flags().BoolVar(&excludeOwnedPods, "exclude-owned-pods", false, "Leave Pods out of the metrics when the workload that owns them, like a Deployment or CronJob, is also watched.")
+	rootCmd.Flags().Float64Var(&registryQPS, "registry-qps", 10, "The number of images that can be fetched from each registry per second. Set to 0 for no limit.")
+	rootCmd.Flags().IntVar(&registryBurst, "registry-burst", 20, "The number of images that can be fetched from each registry at once before --registry-qps applies.")
+	rootCmd.Flags().IntVar(&registryMaxInFlight, "registry-max-in-flight", 10, "The number of images that can be fetched from each registry at the same time. Set to 0 for no limit.")
+	rootCmd.Flags().IntVar(&cacheMaxEntries, "cache-max-entries", 0, "The maximum number of images to cache. The least recently used images are evicted when the limit is reached. Set to 0 for no limit.")
 	rootCmd.Flags().BoolVar(&k8sKeychain, "k8s-keychain", true, "Whether to fetch credentials from pulls secrets in the cluster.")
 }
 
+// inClusterNamespace returns the namespace of the service account that the
+// exporter is running as
+func inClusterNamespace() (string, error) {
+	data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)